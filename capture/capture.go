@@ -0,0 +1,331 @@
+// Package capture reads and writes the traffic of proxied
+// qimessaging connections.
+//
+// A capture file starts with Magic and Version, followed by a
+// sequence of records. Each record carries its kind, a timestamp, the
+// connection it belongs to and a direction:
+//
+//	kind       uint8
+//	time       int64  (nanoseconds since the Unix epoch)
+//	connection uint32
+//	direction  uint8
+//	body
+//
+// The body depends on the kind: the peers of the connection (Open),
+// a complete message (Message), the bytes which cannot be decoded as
+// messages (Data) or the reason of the termination of one direction
+// of the connection (Close). Integers use the qimessaging encoding.
+//
+// A Resolver names the services and the methods of the messages and
+// decodes their payloads. A Rewriter adapts the messages of a
+// recorded client to a new connection and DiffResponses compares the
+// responses of the replay with the recorded ones.
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/basic"
+)
+
+// Magic starts a capture file.
+const Magic = "qicap"
+
+// Version is the version of the format.
+const Version = uint16(1)
+
+// MaxDataSize limits the size of a Data record.
+const MaxDataSize = net.MaxPayloadSize
+
+// Kinds of record:
+const (
+	Open    uint8 = iota + 1 // a connection is accepted
+	Message                  // a message is forwarded
+	Data                     // bytes which are not a message are forwarded
+	Close                    // one direction of a connection terminates
+)
+
+// Direction tells which peer sent the content of a record.
+type Direction uint8
+
+// Directions of a record:
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "->"
+	case ServerToClient:
+		return "<-"
+	default:
+		return fmt.Sprintf("direction(%d)", d)
+	}
+}
+
+// TLSInfo describes the TLS session of a connection.
+type TLSInfo struct {
+	Version     uint16 // tls.VersionTLS12, ...
+	CipherSuite uint16
+	ServerName  string
+}
+
+// Peers describes the endpoints of a connection.
+type Peers struct {
+	Client string
+	Server string
+	TLS    *TLSInfo // nil if the connection is not encrypted
+}
+
+// Record is an event of a proxied connection.
+type Record struct {
+	Kind       uint8
+	Time       time.Time
+	Connection uint32
+	Direction  Direction
+	Peers      Peers       // Open records
+	Message    net.Message // Message records
+	Data       []byte      // Data records
+	Err        string      // Close records, empty on end of file
+}
+
+func (r *Record) writeBody(w io.Writer) error {
+	switch r.Kind {
+	case Open:
+		if err := basic.WriteString(r.Peers.Client, w); err != nil {
+			return err
+		}
+		if err := basic.WriteString(r.Peers.Server, w); err != nil {
+			return err
+		}
+		if err := basic.WriteBool(r.Peers.TLS != nil, w); err != nil {
+			return err
+		}
+		if r.Peers.TLS == nil {
+			return nil
+		}
+		if err := basic.WriteUint16(r.Peers.TLS.Version, w); err != nil {
+			return err
+		}
+		if err := basic.WriteUint16(r.Peers.TLS.CipherSuite, w); err != nil {
+			return err
+		}
+		return basic.WriteString(r.Peers.TLS.ServerName, w)
+	case Message:
+		return r.Message.Write(w)
+	case Data:
+		if len(r.Data) > int(MaxDataSize) {
+			return fmt.Errorf("data too large: %d", len(r.Data))
+		}
+		if err := basic.WriteUint32(uint32(len(r.Data)), w); err != nil {
+			return err
+		}
+		return basic.WriteN(w, r.Data, len(r.Data))
+	case Close:
+		return basic.WriteString(r.Err, w)
+	default:
+		return fmt.Errorf("invalid record kind: %d", r.Kind)
+	}
+}
+
+// Write serializes the record.
+func (r *Record) Write(w io.Writer) error {
+	if err := basic.WriteUint8(r.Kind, w); err != nil {
+		return err
+	}
+	if err := basic.WriteInt64(r.Time.UnixNano(), w); err != nil {
+		return err
+	}
+	if err := basic.WriteUint32(r.Connection, w); err != nil {
+		return err
+	}
+	if err := basic.WriteUint8(uint8(r.Direction), w); err != nil {
+		return err
+	}
+	return r.writeBody(w)
+}
+
+func (r *Record) readBody(rd io.Reader) (err error) {
+	switch r.Kind {
+	case Open:
+		if r.Peers.Client, err = basic.ReadString(rd); err != nil {
+			return err
+		}
+		if r.Peers.Server, err = basic.ReadString(rd); err != nil {
+			return err
+		}
+		encrypted, err := basic.ReadBool(rd)
+		if err != nil || !encrypted {
+			return err
+		}
+		var info TLSInfo
+		if info.Version, err = basic.ReadUint16(rd); err != nil {
+			return err
+		}
+		if info.CipherSuite, err = basic.ReadUint16(rd); err != nil {
+			return err
+		}
+		if info.ServerName, err = basic.ReadString(rd); err != nil {
+			return err
+		}
+		r.Peers.TLS = &info
+		return nil
+	case Message:
+		return r.Message.Read(rd)
+	case Data:
+		size, err := basic.ReadUint32(rd)
+		if err != nil {
+			return err
+		}
+		if size > MaxDataSize {
+			return fmt.Errorf("data too large: %d", size)
+		}
+		r.Data = make([]byte, size)
+		return basic.ReadN(rd, r.Data, int(size))
+	case Close:
+		r.Err, err = basic.ReadString(rd)
+		return err
+	default:
+		return fmt.Errorf("invalid record kind: %d", r.Kind)
+	}
+}
+
+// Read deserializes a record. It returns io.EOF if r is empty.
+func (r *Record) Read(rd io.Reader) error {
+	var err error
+	if r.Kind, err = basic.ReadUint8(rd); err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("read record kind: %s", err)
+	}
+	nanos, err := basic.ReadInt64(rd)
+	if err != nil {
+		return fmt.Errorf("read record time: %s", err)
+	}
+	r.Time = time.Unix(0, nanos)
+	if r.Connection, err = basic.ReadUint32(rd); err != nil {
+		return fmt.Errorf("read record connection: %s", err)
+	}
+	direction, err := basic.ReadUint8(rd)
+	if err != nil {
+		return fmt.Errorf("read record direction: %s", err)
+	}
+	r.Direction = Direction(direction)
+	if err := r.readBody(rd); err != nil {
+		return fmt.Errorf("read record body: %s", err)
+	}
+	return nil
+}
+
+// Writer writes a capture file. A Writer is safe for concurrent use.
+type Writer struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewWriter writes the header of a capture file.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if err := basic.WriteN(w, []byte(Magic), len(Magic)); err != nil {
+		return nil, err
+	}
+	if err := basic.WriteUint16(Version, w); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// Write appends a record to the capture. The record is written in a
+// single write operation.
+func (w *Writer) Write(r *Record) error {
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return basic.WriteN(w.w, buf.Bytes(), buf.Len())
+}
+
+// Reader reads a capture file.
+type Reader struct {
+	r io.Reader
+}
+
+// IsCapture returns true if data starts like a capture file.
+func IsCapture(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// NewReader reads the header of a capture file.
+func NewReader(r io.Reader) (*Reader, error) {
+	magic := make([]byte, len(Magic))
+	if err := basic.ReadN(r, magic, len(magic)); err != nil {
+		return nil, fmt.Errorf("read capture magic: %s", err)
+	}
+	if !IsCapture(magic) {
+		return nil, fmt.Errorf("not a capture: %q", magic)
+	}
+	version, err := basic.ReadUint16(r)
+	if err != nil {
+		return nil, fmt.Errorf("read capture version: %s", err)
+	}
+	if version != Version {
+		return nil, fmt.Errorf("unsupported capture version: %d", version)
+	}
+	return &Reader{r: r}, nil
+}
+
+// Read returns the next record. It returns io.EOF at the end of the
+// capture.
+func (r *Reader) Read() (Record, error) {
+	var record Record
+	err := record.Read(r.r)
+	return record, err
+}
+
+// ReadAll returns the records of a capture file. A capture is
+// truncated if the proxy did not terminate cleanly: the records read
+// so far are returned with the error.
+func ReadAll(r io.Reader) ([]Record, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// Stream designates one direction of a connection.
+type Stream struct {
+	Connection uint32
+	Direction  Direction
+}
+
+// Streams returns the messages of the records grouped by stream, in
+// the order they were forwarded.
+func Streams(records []Record) map[Stream][]net.Message {
+	streams := make(map[Stream][]net.Message)
+	for _, r := range records {
+		if r.Kind != Message {
+			continue
+		}
+		s := Stream{r.Connection, r.Direction}
+		streams[s] = append(streams[s], r.Message)
+	}
+	return streams
+}
@@ -0,0 +1,350 @@
+package capture_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/directory"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
+)
+
+func TestReadWrite(t *testing.T) {
+	now := time.Unix(0, time.Now().UnixNano())
+	message := net.NewMessage(net.NewHeader(net.Call, 1, 1, 100, 3),
+		[]byte{1, 2, 3})
+	records := []capture.Record{
+		{
+			Kind:       capture.Open,
+			Time:       now,
+			Connection: 1,
+			Peers: capture.Peers{
+				Client: "127.0.0.1:4242",
+				Server: "10.0.0.1:9503",
+				TLS: &capture.TLSInfo{
+					Version:     tls.VersionTLS12,
+					CipherSuite: tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+					ServerName:  "robot",
+				},
+			},
+		},
+		{
+			Kind:       capture.Message,
+			Time:       now,
+			Connection: 1,
+			Message:    message,
+		},
+		{
+			Kind:       capture.Data,
+			Time:       now,
+			Connection: 1,
+			Direction:  capture.ServerToClient,
+			Data:       []byte("garbage"),
+		},
+		{
+			Kind:       capture.Close,
+			Time:       now,
+			Connection: 1,
+			Direction:  capture.ServerToClient,
+			Err:        "connection reset by peer",
+		},
+	}
+	var buf bytes.Buffer
+	w, err := capture.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		if err := w.Write(&records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !capture.IsCapture(buf.Bytes()) {
+		t.Errorf("missing magic")
+	}
+	got, err := capture.ReadAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		if i < len(got) && !reflect.DeepEqual(records[i], got[i]) {
+			t.Errorf("record %d: expected %#v, got %#v", i, records[i], got[i])
+		}
+	}
+	streams := capture.Streams(got)
+	s := capture.Stream{Connection: 1, Direction: capture.ClientToServer}
+	if len(streams) != 1 || len(streams[s]) != 1 {
+		t.Errorf("unexpected streams: %v", streams)
+	}
+
+	// truncated capture
+	got, err = capture.ReadAll(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err == nil || len(got) != len(records)-1 {
+		t.Errorf("truncated capture: %d records, %v", len(got), err)
+	}
+	if _, err := capture.ReadAll(bytes.NewReader([]byte("qimessaging"))); err == nil {
+		t.Errorf("invalid magic accepted")
+	}
+}
+
+// sum returns the one's complement sum of data, 0xffff if the
+// checksum embedded in data is valid.
+func sum(data []byte, s uint32) uint32 {
+	for ; len(data) >= 2; data = data[2:] {
+		s += uint32(binary.BigEndian.Uint16(data))
+	}
+	if len(data) == 1 {
+		s += uint32(data[0]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return s
+}
+
+func TestPcap(t *testing.T) {
+	now := time.Now()
+	message := net.NewMessage(net.NewHeader(net.Call, 1, 1, 100, 3),
+		[]byte{1, 2, 3})
+	var serialized bytes.Buffer
+	message.Write(&serialized)
+	data := bytes.Repeat([]byte{0xaa}, 100000)
+	records := []capture.Record{
+		{Kind: capture.Open, Time: now, Connection: 1, Peers: capture.Peers{
+			Client: "192.168.1.2:4242", Server: "192.168.1.10:9503",
+		}},
+		{Kind: capture.Message, Time: now, Connection: 1, Message: message},
+		{Kind: capture.Data, Time: now, Connection: 1,
+			Direction: capture.ServerToClient, Data: data},
+		{Kind: capture.Close, Time: now, Connection: 1},
+	}
+	var buf bytes.Buffer
+	w, err := capture.NewPcapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		if err := w.Write(&records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := buf.Bytes()
+	var types []uint32
+	payloads := make(map[uint16][]byte) // indexed by source port
+	for len(file) != 0 {
+		typ := binary.LittleEndian.Uint32(file)
+		size := binary.LittleEndian.Uint32(file[4:])
+		if size%4 != 0 || int(size) > len(file) ||
+			binary.LittleEndian.Uint32(file[size-4:]) != size {
+			t.Fatalf("invalid block size: %d", size)
+		}
+		types = append(types, typ)
+		if typ == 6 {
+			length := binary.LittleEndian.Uint32(file[20:])
+			ip := file[28 : 28+length]
+			if ip[0]>>4 != 4 || sum(ip[:20], 0) != 0xffff {
+				t.Errorf("invalid IP header: %x", ip[:20])
+			}
+			tcp := ip[20:]
+			pseudo := append(append([]byte{}, ip[12:20]...), 0, 6,
+				byte(len(tcp)>>8), byte(len(tcp)))
+			if sum(tcp, sum(pseudo, 0)) != 0xffff {
+				t.Errorf("invalid TCP checksum")
+			}
+			port := binary.BigEndian.Uint16(tcp)
+			payloads[port] = append(payloads[port], tcp[20:]...)
+		}
+		file = file[size:]
+	}
+	// section, interface, handshake, message, 2 segments of data, FIN
+	expected := []uint32{0x0A0D0D0A, 1, 6, 6, 6, 6, 6, 6, 6}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("unexpected blocks: %x", types)
+	}
+	if !bytes.Equal(payloads[4242], serialized.Bytes()) {
+		t.Errorf("unexpected client stream: %x", payloads[4242])
+	}
+	if !bytes.Equal(payloads[9503], data) {
+		t.Errorf("unexpected server stream: %d bytes", len(payloads[9503]))
+	}
+}
+
+func TestResolver(t *testing.T) {
+	r := capture.NewResolver()
+	reply := func(service, obj, action uint32, payload []byte) net.Message {
+		hdr := net.NewHeader(net.Reply, service, obj, action, 3)
+		return net.NewMessage(hdr, payload)
+	}
+
+	var services bytes.Buffer
+	basic.WriteUint32(1, &services)
+	directory.WriteServiceInfo(directory.ServiceInfo{
+		Name:      "Speech",
+		ServiceId: 7,
+		Endpoints: []string{"tcp://127.0.0.1:9559"},
+	}, &services)
+	a := r.Resolve(reply(1, 1, 101, services.Bytes()))
+	if a.Service != "ServiceDirectory" || a.Action != "services" || a.Err != nil {
+		t.Errorf("unexpected annotation: %#v", a)
+	}
+
+	var meta bytes.Buffer
+	object.WriteMetaObject(object.MetaObject{
+		Description: "Speech",
+		Methods: map[uint32]object.MetaMethod{
+			100: {
+				Uid:                 100,
+				Name:                "say",
+				ParametersSignature: "(s)",
+				ReturnSignature:     "v",
+			},
+		},
+	}, &meta)
+	r.Resolve(reply(7, 1, object.MetaObjectMethodID, meta.Bytes()))
+
+	var say bytes.Buffer
+	basic.WriteString("hello", &say)
+	call := net.NewMessage(net.NewHeader(net.Call, 7, 1, 100, 5), say.Bytes())
+	a = r.Resolve(call)
+	if a.Service != "Speech" || a.Action != "say" ||
+		a.Signature != "(s)" || a.Payload != `("hello")` {
+		t.Errorf("unexpected annotation: %#v", a)
+	}
+	if s := a.String(); s != `Speech.say (s) ("hello")` {
+		t.Errorf("unexpected description: %s", s)
+	}
+
+	r.Lookup(reply(7, 2, object.MetaObjectMethodID, meta.Bytes()))
+	call = net.NewMessage(net.NewHeader(net.Call, 7, 2, 100, 7), say.Bytes())
+	if a = r.Lookup(call); a.Action != "" {
+		t.Errorf("learned by Lookup: %#v", a)
+	}
+}
+
+func TestFormatPayload(t *testing.T) {
+	var buf bytes.Buffer
+	basic.WriteUint32(2, &buf)
+	basic.WriteString("a", &buf)
+	basic.WriteInt32(-1, &buf)
+	basic.WriteString("b", &buf)
+	basic.WriteInt32(2, &buf)
+	sig := "({si}+b)<Pair,map,option>"
+	data := append(buf.Bytes(), 0)
+	if s, err := capture.FormatPayload(sig, data); err != nil ||
+		s != `Pair{map: {"a": -1, "b": 2}, option: none}` {
+		t.Errorf("unexpected value: %s, %v", s, err)
+	}
+	// a list announcing more elements than the payload holds
+	oversized := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	if _, err := capture.FormatPayload("[[s]]", oversized); err == nil {
+		t.Errorf("oversized list accepted")
+	}
+	// an embedded signature nested too deep
+	buf.Reset()
+	basic.WriteString(strings.Repeat("[", 1<<16), &buf)
+	if _, err := capture.FormatPayload("m", buf.Bytes()); err == nil {
+		t.Errorf("invalid embedded signature accepted")
+	}
+}
+
+func TestParseSignature(t *testing.T) {
+	for _, sig := range []string{
+		"s", "[+m]", "{s#i}", "(L[d])<Matrix<double>,size,data>",
+	} {
+		typ, err := capture.ParseSignature(sig)
+		if err != nil {
+			t.Errorf("%s: %s", sig, err)
+		} else if typ.String() != sig {
+			t.Errorf("%s became %s", sig, typ)
+		}
+	}
+	for _, sig := range []string{"", "[s", "(s)<Pair", "si", "z"} {
+		if _, err := capture.ParseSignature(sig); err == nil {
+			t.Errorf("%q accepted", sig)
+		}
+	}
+}
+
+func TestRewriter(t *testing.T) {
+	w := capture.NewRewriter("", "secret")
+	var cm bytes.Buffer
+	bus.WriteCapabilityMap(bus.CapabilityMap{
+		bus.KeyUser:  value.String("nao"),
+		bus.KeyToken: value.String("nao"),
+	}, &cm)
+	auth := net.NewMessage(net.NewHeader(net.Call, 0, 0,
+		object.AuthenticateActionID, 42), cm.Bytes())
+	m := w.Rewrite(auth)
+	if m.Header.ID != 1 || m.Header.Size != uint32(len(m.Payload)) {
+		t.Errorf("unexpected header: %s", m.Header)
+	}
+	got, err := bus.ReadCapabilityMap(bytes.NewBuffer(m.Payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[bus.KeyUser] != value.String("nao") ||
+		got[bus.KeyToken] != value.String("secret") {
+		t.Errorf("unexpected credentials: %v", got)
+	}
+	call := net.NewMessage(net.NewHeader(net.Call, 1, 1, 100, 43), nil)
+	w.Rewrite(call)
+	var id bytes.Buffer
+	basic.WriteUint32(43, &id)
+	cancel := w.Rewrite(net.NewMessage(net.NewHeader(net.Cancel, 1, 1, 100, 44),
+		id.Bytes()))
+	if n, _ := basic.ReadUint32(bytes.NewBuffer(cancel.Payload)); n != 2 {
+		t.Errorf("cancel not rewritten: %d", n)
+	}
+	if recorded, ok := w.Recorded(3); !ok || recorded != 44 {
+		t.Errorf("unexpected recorded ID: %d", recorded)
+	}
+}
+
+func TestDiffResponses(t *testing.T) {
+	response := func(typ uint8, action, id uint32, cm bus.CapabilityMap) net.Message {
+		var buf bytes.Buffer
+		bus.WriteCapabilityMap(cm, &buf)
+		hdr := net.NewHeader(typ, 0, 0, action, id)
+		return net.NewMessage(hdr, buf.Bytes())
+	}
+	// the entries of cm are serialized in any order, the responses
+	// to authenticate are compared once decoded.
+	cm := bus.CapabilityMap{
+		"a": value.Int(1), "b": value.Int(2), "c": value.Int(3),
+	}
+	// the action 9 is unknown: its responses are compared as bytes.
+	single := bus.CapabilityMap{"a": value.Int(1)}
+	// the same ID answers two different calls.
+	recorded := []net.Message{
+		response(net.Reply, object.AuthenticateActionID, 3, cm),
+		response(net.Reply, object.AuthenticateActionID, 4, cm),
+		response(net.Reply, 9, 3, single),
+		response(net.Reply, 9, 5, single),
+	}
+	replayed := []net.Message{
+		response(net.Reply, 9, 3, single),
+		response(net.Reply, object.AuthenticateActionID, 3, cm),
+		response(net.Error, object.AuthenticateActionID, 4, cm),
+		response(net.Reply, 9, 6, single),
+	}
+	same, diffs := capture.DiffResponses(recorded, replayed,
+		capture.NewResolver())
+	if same != 2 || len(diffs) != 3 {
+		t.Fatalf("unexpected diff: %d identical, %v", same, diffs)
+	}
+	if diffs[0].ID != 4 || diffs[0].Replayed == nil ||
+		diffs[1].ID != 5 || diffs[1].Replayed != nil ||
+		diffs[2].ID != 6 || diffs[2].Recorded != nil {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+}
@@ -0,0 +1,258 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lugu/qiloop/meta/signature"
+	"github.com/lugu/qiloop/type/basic"
+)
+
+// metaObjectType is the type of the MetaObject of an object
+// reference.
+var metaObjectType *Type
+
+func init() {
+	var err error
+	metaObjectType, err = ParseSignature(signature.MetaObjectSignature)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// FormatPayload decodes a payload of type sig and returns a
+// description of the value. The entries of the maps are sorted so
+// equal values have the same description. The decoders of qiloop
+// trust the sizes announced by the payload: FormatPayload checks them
+// against its length, so a hostile payload cannot exhaust the memory
+// of the decoder.
+func FormatPayload(sig string, data []byte) (string, error) {
+	t, err := ParseSignature(sig)
+	if err != nil {
+		return "", err
+	}
+	r := bytes.NewReader(data)
+	var w strings.Builder
+	if err := formatValue(t, r, &w, 0); err != nil {
+		return w.String(), err
+	}
+	if r.Len() != 0 {
+		return w.String(), fmt.Errorf("%d trailing bytes", r.Len())
+	}
+	return w.String(), nil
+}
+
+// readSize reads the size of a string or of a collection. Since each
+// element is at least one byte long, the size cannot exceed the
+// remaining bytes.
+func readSize(r *bytes.Reader) (int, error) {
+	size, err := basic.ReadUint32(r)
+	if err != nil {
+		return 0, err
+	}
+	if int64(size) > int64(r.Len()) {
+		return 0, fmt.Errorf("size %d exceeds the %d remaining bytes",
+			size, r.Len())
+	}
+	return int(size), nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	size, err := readSize(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+// formatBasic decodes a value of a basic type.
+func formatBasic(kind byte, r *bytes.Reader, w *strings.Builder) error {
+	switch kind {
+	case 'b':
+		v, err := basic.ReadBool(r)
+		fmt.Fprintf(w, "%t", v)
+		return err
+	case 'c':
+		v, err := basic.ReadInt8(r)
+		fmt.Fprintf(w, "%d", v)
+		return err
+	case 'C':
+		v, err := basic.ReadUint8(r)
+		fmt.Fprintf(w, "%d", v)
+		return err
+	case 'w':
+		v, err := basic.ReadInt16(r)
+		fmt.Fprintf(w, "%d", v)
+		return err
+	case 'W':
+		v, err := basic.ReadUint16(r)
+		fmt.Fprintf(w, "%d", v)
+		return err
+	case 'i':
+		v, err := basic.ReadInt32(r)
+		fmt.Fprintf(w, "%d", v)
+		return err
+	case 'I':
+		v, err := basic.ReadUint32(r)
+		fmt.Fprintf(w, "%d", v)
+		return err
+	case 'l':
+		v, err := basic.ReadInt64(r)
+		fmt.Fprintf(w, "%d", v)
+		return err
+	case 'L':
+		v, err := basic.ReadUint64(r)
+		fmt.Fprintf(w, "%d", v)
+		return err
+	case 'f':
+		v, err := basic.ReadFloat32(r)
+		fmt.Fprintf(w, "%g", v)
+		return err
+	case 'd':
+		v, err := basic.ReadFloat64(r)
+		fmt.Fprintf(w, "%g", v)
+		return err
+	case 's':
+		v, err := readBytes(r)
+		w.WriteString(strconv.Quote(string(v)))
+		return err
+	case 'r':
+		v, err := readBytes(r)
+		fmt.Fprintf(w, "0x%x", v)
+		return err
+	case 'v':
+		return nil
+	default:
+		return fmt.Errorf("unsupported type %q", kind)
+	}
+}
+
+// formatValue decodes a value of type t. depth is the nesting of
+// the value, embedded values included.
+func formatValue(t *Type, r *bytes.Reader, w *strings.Builder, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("types nested too deep")
+	}
+	switch t.Kind {
+	case '[', '#':
+		return formatList(t, r, w, depth)
+	case '{':
+		return formatMap(t, r, w, depth)
+	case '(':
+		return formatTuple(t, r, w, depth)
+	case '+':
+		set, err := basic.ReadBool(r)
+		if err != nil {
+			return err
+		}
+		if !set {
+			w.WriteString("none")
+			return nil
+		}
+		return formatValue(t.Members[0], r, w, depth+1)
+	case 'm':
+		sig, err := readBytes(r)
+		if err != nil {
+			return err
+		}
+		embedded, err := ParseSignature(string(sig))
+		if err != nil {
+			return err
+		}
+		return formatValue(embedded, r, w, depth+1)
+	case 'o':
+		var meta strings.Builder
+		if err := formatValue(metaObjectType, r, &meta, depth+1); err != nil {
+			return err
+		}
+		service, err := basic.ReadUint32(r)
+		if err != nil {
+			return err
+		}
+		object, err := basic.ReadUint32(r)
+		fmt.Fprintf(w, "object(service %d, object %d)", service, object)
+		return err
+	default:
+		return formatBasic(t.Kind, r, w)
+	}
+}
+
+// formatList decodes a list ('[') or varargs ('#') value.
+func formatList(t *Type, r *bytes.Reader, w *strings.Builder, depth int) error {
+	size, err := readSize(r)
+	if err != nil {
+		return err
+	}
+	w.WriteString("[")
+	for i := 0; i < size; i++ {
+		if i != 0 {
+			w.WriteString(", ")
+		}
+		if err := formatValue(t.Members[0], r, w, depth+1); err != nil {
+			return err
+		}
+	}
+	w.WriteString("]")
+	return nil
+}
+
+// formatMap decodes a map.
+func formatMap(t *Type, r *bytes.Reader, w *strings.Builder, depth int) error {
+	size, err := readSize(r)
+	if err != nil {
+		return err
+	}
+	// the entries are sorted: the order of serialization does not
+	// matter.
+	entries := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		var entry strings.Builder
+		err := formatValue(t.Members[0], r, &entry, depth+1)
+		if err == nil {
+			entry.WriteString(": ")
+			err = formatValue(t.Members[1], r, &entry, depth+1)
+		}
+		entries = append(entries, entry.String())
+		if err != nil {
+			w.WriteString("{" + strings.Join(entries, ", "))
+			return err
+		}
+	}
+	sort.Strings(entries)
+	w.WriteString("{" + strings.Join(entries, ", ") + "}")
+	return nil
+}
+
+// formatTuple decodes a tuple or a struct. The members of a struct
+// are named after its fields.
+func formatTuple(t *Type, r *bytes.Reader, w *strings.Builder, depth int) error {
+	named := t.Name != "" && len(t.Fields) == len(t.Members)
+	if named {
+		w.WriteString(t.Name + "{")
+	} else {
+		w.WriteString("(")
+	}
+	for i, m := range t.Members {
+		if i != 0 {
+			w.WriteString(", ")
+		}
+		if named {
+			w.WriteString(t.Fields[i] + ": ")
+		}
+		if err := formatValue(m, r, w, depth+1); err != nil {
+			return err
+		}
+	}
+	if named {
+		w.WriteString("}")
+	} else {
+		w.WriteString(")")
+	}
+	return nil
+}
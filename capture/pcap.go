@@ -0,0 +1,313 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	gonet "net"
+	"strconv"
+	"sync"
+)
+
+// The pcapng export turns the records into TCP segments so the
+// decrypted traffic can be read by Wireshark: each connection is
+// given a three-way handshake, its messages become the payload of
+// the segments and a Close record ends a direction with a FIN.
+
+const (
+	blockSection   = 0x0A0D0D0A
+	blockInterface = 0x00000001
+	blockPacket    = 0x00000006
+	byteOrderMagic = 0x1A2B3C4D
+	linkTypeRaw    = 101 // raw IPv4 or IPv6 packets
+
+	optionEnd        = 0
+	optionComment    = 1
+	optionTimeResol  = 9
+	timeResolNanosec = 9
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// maxSegment keeps the IP packets within 64KB.
+	maxSegment = 65535 - 60 - 20
+)
+
+// endpoint is an address of a synthesized connection.
+type endpoint struct {
+	ip   gonet.IP
+	port uint16
+}
+
+// parseEndpoint returns the endpoint described by addr. The
+// addresses which are not IP addresses (like unix sockets) are
+// replaced with the loopback address and a port derived from the
+// connection.
+func parseEndpoint(addr string, fallbackPort uint16) endpoint {
+	host, port, err := gonet.SplitHostPort(addr)
+	if err == nil {
+		ip := gonet.ParseIP(host)
+		p, err := strconv.ParseUint(port, 10, 16)
+		if ip != nil && err == nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			return endpoint{ip, uint16(p)}
+		}
+	}
+	return endpoint{gonet.IPv4(127, 0, 0, 1).To4(), fallbackPort}
+}
+
+// tcpStream is the state of one direction of a connection.
+type tcpStream struct {
+	src, dst endpoint
+	seq      uint32
+}
+
+// tcpConnection is the state of a synthesized connection.
+type tcpConnection struct {
+	streams [2]tcpStream // indexed by direction
+	closed  [2]bool      // indexed by direction
+}
+
+// PcapWriter exports records as a pcapng file. A PcapWriter is safe
+// for concurrent use.
+type PcapWriter struct {
+	mutex       sync.Mutex
+	w           io.Writer
+	connections map[uint32]*tcpConnection
+}
+
+// NewPcapWriter writes the section header and the interface
+// description of a pcapng file.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	var section bytes.Buffer
+	binary.Write(&section, binary.LittleEndian, uint32(byteOrderMagic))
+	binary.Write(&section, binary.LittleEndian, uint16(1)) // major version
+	binary.Write(&section, binary.LittleEndian, uint16(0)) // minor version
+	binary.Write(&section, binary.LittleEndian, int64(-1)) // unknown length
+	if err := writeBlock(w, blockSection, section.Bytes()); err != nil {
+		return nil, err
+	}
+	var iface bytes.Buffer
+	binary.Write(&iface, binary.LittleEndian, uint16(linkTypeRaw))
+	binary.Write(&iface, binary.LittleEndian, uint16(0)) // reserved
+	binary.Write(&iface, binary.LittleEndian, uint32(0)) // no snap length
+	writeOption(&iface, optionTimeResol, []byte{timeResolNanosec})
+	writeOption(&iface, optionEnd, nil)
+	if err := writeBlock(w, blockInterface, iface.Bytes()); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{
+		w:           w,
+		connections: make(map[uint32]*tcpConnection),
+	}, nil
+}
+
+// pad4 returns the padding of a field of size n.
+func pad4(n int) []byte {
+	return make([]byte, (4-n%4)%4)
+}
+
+func writeOption(buf *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(buf, binary.LittleEndian, code)
+	binary.Write(buf, binary.LittleEndian, uint16(len(value)))
+	buf.Write(value)
+	buf.Write(pad4(len(value)))
+}
+
+// writeBlock writes a block in a single write operation.
+func writeBlock(w io.Writer, typ uint32, body []byte) error {
+	size := uint32(12 + len(body))
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, typ)
+	binary.Write(&buf, binary.LittleEndian, size)
+	buf.Write(body)
+	binary.Write(&buf, binary.LittleEndian, size)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// checksum returns the internet checksum of data.
+func checksum(data []byte, sum uint32) uint16 {
+	for ; len(data) >= 2; data = data[2:] {
+		sum += uint32(data[0])<<8 | uint32(data[1])
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// packet returns an IP packet carrying a TCP segment.
+func packet(s *tcpStream, ack uint32, flags uint8, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], s.src.port)
+	binary.BigEndian.PutUint16(tcp[2:], s.dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], s.seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+	tcp[12] = 5 << 4 // header length
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff) // window
+	copy(tcp[20:], payload)
+
+	// pseudo header
+	var pseudo bytes.Buffer
+	pseudo.Write(s.src.ip)
+	pseudo.Write(s.dst.ip)
+	if len(s.src.ip) == gonet.IPv4len {
+		pseudo.Write([]byte{0, 6})
+		binary.Write(&pseudo, binary.BigEndian, uint16(len(tcp)))
+	} else {
+		binary.Write(&pseudo, binary.BigEndian, uint32(len(tcp)))
+		pseudo.Write([]byte{0, 0, 0, 6})
+	}
+	binary.BigEndian.PutUint16(tcp[16:],
+		checksum(tcp, uint32(^checksum(pseudo.Bytes(), 0))))
+
+	if len(s.src.ip) == gonet.IPv4len {
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64 // TTL
+		ip[9] = 6  // TCP
+		copy(ip[12:], s.src.ip)
+		copy(ip[16:], s.dst.ip)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		return append(ip, tcp...)
+	}
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6  // TCP
+	ip[7] = 64 // hop limit
+	copy(ip[8:], s.src.ip)
+	copy(ip[24:], s.dst.ip)
+	return append(ip, tcp...)
+}
+
+// writePacket writes an enhanced packet block.
+func (p *PcapWriter) writePacket(r *Record, data []byte, comment string) error {
+	nanos := uint64(r.Time.UnixNano())
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint32(0)) // interface
+	binary.Write(&body, binary.LittleEndian, uint32(nanos>>32))
+	binary.Write(&body, binary.LittleEndian, uint32(nanos))
+	binary.Write(&body, binary.LittleEndian, uint32(len(data)))
+	binary.Write(&body, binary.LittleEndian, uint32(len(data)))
+	body.Write(data)
+	body.Write(pad4(len(data)))
+	if comment != "" {
+		writeOption(&body, optionComment, []byte(comment))
+		writeOption(&body, optionEnd, nil)
+	}
+	return writeBlock(p.w, blockPacket, body.Bytes())
+}
+
+// segment sends a TCP segment in direction d of c and advances its
+// sequence number.
+func (p *PcapWriter) segment(r *Record, c *tcpConnection, d Direction,
+	flags uint8, payload []byte, comment string) error {
+	s := &c.streams[d]
+	ack := c.streams[1-d].seq
+	data := packet(s, ack, flags, payload)
+	s.seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		s.seq++
+	}
+	return p.writePacket(r, data, comment)
+}
+
+// connection returns the state of a connection, creating it with
+// the addresses of peers.
+func (p *PcapWriter) connection(id uint32, peers Peers) *tcpConnection {
+	if c, ok := p.connections[id]; ok {
+		return c
+	}
+	client := parseEndpoint(peers.Client, uint16(1024+id%60000))
+	server := parseEndpoint(peers.Server, 9559)
+	if len(client.ip) != len(server.ip) {
+		// mixing IPv4 and IPv6 is not possible in a packet
+		client.ip = client.ip.To16()
+		server.ip = server.ip.To16()
+	}
+	c := &tcpConnection{}
+	c.streams[ClientToServer] = tcpStream{src: client, dst: server}
+	c.streams[ServerToClient] = tcpStream{src: server, dst: client}
+	p.connections[id] = c
+	return c
+}
+
+// describe returns the annotation of an Open record.
+func describe(peers Peers) string {
+	if peers.TLS == nil {
+		return fmt.Sprintf("%s -> %s", peers.Client, peers.Server)
+	}
+	return fmt.Sprintf("%s -> %s (TLS version %#04x, cipher suite %#04x, server name %q)",
+		peers.Client, peers.Server, peers.TLS.Version,
+		peers.TLS.CipherSuite, peers.TLS.ServerName)
+}
+
+// Write exports a record: an Open record is exported as a three-way
+// handshake, the content of the Message and Data records as TCP
+// segments and a Close record as a FIN segment. The records of a
+// connection not opened are exported without handshake. The state of
+// a connection is released once both directions are closed.
+func (p *PcapWriter) Write(r *Record) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch r.Kind {
+	case Open:
+		delete(p.connections, r.Connection)
+		c := p.connection(r.Connection, r.Peers)
+		err := p.segment(r, c, ClientToServer, tcpSYN, nil, describe(r.Peers))
+		if err != nil {
+			return err
+		}
+		err = p.segment(r, c, ServerToClient, tcpSYN|tcpACK, nil, "")
+		if err != nil {
+			return err
+		}
+		return p.segment(r, c, ClientToServer, tcpACK, nil, "")
+	case Message, Data:
+		payload := r.Data
+		if r.Kind == Message {
+			var buf bytes.Buffer
+			if err := r.Message.Write(&buf); err != nil {
+				return err
+			}
+			payload = buf.Bytes()
+		}
+		c := p.connection(r.Connection, Peers{})
+		for len(payload) != 0 {
+			size := len(payload)
+			if size > maxSegment {
+				size = maxSegment
+			}
+			err := p.segment(r, c, r.Direction, tcpPSH|tcpACK,
+				payload[:size], "")
+			if err != nil {
+				return err
+			}
+			payload = payload[size:]
+		}
+		return nil
+	case Close:
+		c := p.connection(r.Connection, Peers{})
+		c.closed[r.Direction] = true
+		if c.closed[ClientToServer] && c.closed[ServerToClient] {
+			delete(p.connections, r.Connection)
+		}
+		return p.segment(r, c, r.Direction, tcpFIN|tcpACK, nil, r.Err)
+	default:
+		return fmt.Errorf("invalid record kind: %d", r.Kind)
+	}
+}
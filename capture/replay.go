@@ -0,0 +1,220 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// Connections returns the connections of the records which forward
+// messages, in the order they were opened.
+func Connections(records []Record) []uint32 {
+	seen := make(map[uint32]bool)
+	var ids []uint32
+	for _, r := range records {
+		if r.Kind == Message && !seen[r.Connection] {
+			seen[r.Connection] = true
+			ids = append(ids, r.Connection)
+		}
+	}
+	return ids
+}
+
+// Messages returns the Message records of one direction of a
+// connection.
+func Messages(records []Record, s Stream) []Record {
+	var messages []Record
+	for _, r := range records {
+		if r.Kind == Message && r.Connection == s.Connection &&
+			r.Direction == s.Direction {
+			messages = append(messages, r)
+		}
+	}
+	return messages
+}
+
+// IsAuthentication returns true if m carries a capability map with
+// credentials: the authenticate calls and the capability messages.
+func IsAuthentication(m net.Message) bool {
+	hdr := m.Header
+	return hdr.Type == net.Capability || (hdr.Type == net.Call &&
+		hdr.Service == 0 && hdr.Object == 0 &&
+		hdr.Action == object.AuthenticateActionID)
+}
+
+// IsResponse returns true if m answers a call.
+func IsResponse(m net.Message) bool {
+	switch m.Header.Type {
+	case net.Reply, net.Error, net.Cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Rewriter adapts the client messages of a recorded connection to a
+// new connection: the messages are numbered from 1, the
+// credentials of the authentication are replaced and the Cancel
+// messages designate the new IDs.
+type Rewriter struct {
+	User  string // replaces the recorded user, if not empty
+	Token string // replaces the recorded token, if not empty
+
+	nextID   uint32
+	replayed map[uint32]uint32 // recorded ID -> replayed ID
+	recorded map[uint32]uint32 // replayed ID -> recorded ID
+}
+
+// NewRewriter returns a rewriter replacing the recorded credentials
+// with user and token, unless they are empty.
+func NewRewriter(user, token string) *Rewriter {
+	return &Rewriter{
+		User:     user,
+		Token:    token,
+		nextID:   1,
+		replayed: make(map[uint32]uint32),
+		recorded: make(map[uint32]uint32),
+	}
+}
+
+// rewriteCredentials replaces the credentials of a serialized
+// capability map. The payload is kept if it is not a capability map.
+func (w *Rewriter) rewriteCredentials(payload []byte) []byte {
+	if (w.User == "" && w.Token == "") || !valid("{sm}", payload) {
+		return payload
+	}
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(payload))
+	if err != nil {
+		return payload
+	}
+	if w.User != "" {
+		cm[bus.KeyUser] = value.String(w.User)
+	}
+	if w.Token != "" {
+		cm[bus.KeyToken] = value.String(w.Token)
+	}
+	var buf bytes.Buffer
+	if err := bus.WriteCapabilityMap(cm, &buf); err != nil {
+		return payload
+	}
+	return buf.Bytes()
+}
+
+// Rewrite returns the message to send in place of a recorded client
+// message.
+func (w *Rewriter) Rewrite(m net.Message) net.Message {
+	hdr := m.Header
+	payload := m.Payload
+	switch {
+	case hdr.Type == net.Cancel && len(payload) == 4:
+		// the payload is the ID of the call to cancel
+		id := binary.LittleEndian.Uint32(payload)
+		if replayed, ok := w.replayed[id]; ok {
+			payload = make([]byte, 4)
+			binary.LittleEndian.PutUint32(payload, replayed)
+		}
+	case IsAuthentication(m):
+		// the parameters of authenticate, ({sm}), are serialized
+		// like a capability map.
+		payload = w.rewriteCredentials(payload)
+	}
+	id := w.nextID
+	w.nextID++
+	w.replayed[hdr.ID] = id
+	w.recorded[id] = hdr.ID
+	hdr.ID = id
+	hdr.Size = uint32(len(payload))
+	return net.NewMessage(hdr, payload)
+}
+
+// Recorded returns the recorded ID of a replayed message.
+func (w *Rewriter) Recorded(id uint32) (uint32, bool) {
+	recorded, ok := w.recorded[id]
+	return recorded, ok
+}
+
+// Difference is a response which differs between a recorded
+// connection and its replay.
+type Difference struct {
+	ID       uint32       // recorded ID of the call
+	Recorded *net.Message // nil if the response was not recorded
+	Replayed *net.Message // nil if the response was not received
+}
+
+// CallKey designates a call and its responses. Since the clients can
+// reuse the IDs, the action is part of the key.
+type CallKey struct {
+	ID, Service, Object, Action uint32
+}
+
+// NewCallKey returns the key of the call sent, or answered, with hdr.
+func NewCallKey(hdr net.Header) CallKey {
+	return CallKey{hdr.ID, hdr.Service, hdr.Object, hdr.Action}
+}
+
+// equalPayloads returns true if two responses carry the same value.
+// Unless resolver is nil, the payloads are compared once decoded so
+// the order of the map entries does not matter. The resolver does not
+// learn from the responses.
+func equalPayloads(a, b *net.Message, resolver *Resolver) bool {
+	if bytes.Equal(a.Payload, b.Payload) {
+		return true
+	}
+	if resolver == nil {
+		return false
+	}
+	x, y := resolver.Lookup(*a), resolver.Lookup(*b)
+	return x.Err == nil && y.Err == nil && x.Signature != "" &&
+		x.Signature == y.Signature && x.Payload == y.Payload
+}
+
+// DiffResponses compares the responses (replies, errors and
+// cancellations) recorded with those received during the replay,
+// whose IDs are mapped to the recorded ones. The responses to the
+// same call are compared in order, using resolver to decode the
+// payloads if not nil. It returns the number of identical responses
+// and the differences ordered by recorded response, followed by the
+// unexpected responses.
+func DiffResponses(recorded, replayed []net.Message, resolver *Resolver) (int, []Difference) {
+	responses := make(map[CallKey][]*net.Message)
+	for i := range replayed {
+		m := &replayed[i]
+		if IsResponse(*m) {
+			key := NewCallKey(m.Header)
+			responses[key] = append(responses[key], m)
+		}
+	}
+	same := 0
+	var diffs []Difference
+	for i := range recorded {
+		r := &recorded[i]
+		if !IsResponse(*r) {
+			continue
+		}
+		key := NewCallKey(r.Header)
+		if len(responses[key]) == 0 {
+			diffs = append(diffs, Difference{r.Header.ID, r, nil})
+			continue
+		}
+		m := responses[key][0]
+		responses[key] = responses[key][1:]
+		if m.Header.Type != r.Header.Type || !equalPayloads(r, m, resolver) {
+			diffs = append(diffs, Difference{r.Header.ID, r, m})
+		} else {
+			same++
+		}
+	}
+	for i := range replayed {
+		m := &replayed[i]
+		key := NewCallKey(m.Header)
+		if IsResponse(*m) && len(responses[key]) != 0 && responses[key][0] == m {
+			diffs = append(diffs, Difference{m.Header.ID, nil, m})
+			responses[key] = responses[key][1:]
+		}
+	}
+	return same, diffs
+}
@@ -0,0 +1,228 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/lugu/qiloop/bus/directory"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/meta/signature"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// The ServiceDirectory is the service 1 of every session. Its object
+// 1 lists the services.
+const (
+	directoryServiceID = 1
+	directoryObjectID  = 1
+	serviceInfoSig     = "(sIsI[s]ss)<ServiceInfo,name,serviceId," +
+		"machineId,processId,endpoints,sessionId,objectUid>"
+)
+
+// directoryMetaObject describes the methods of the ServiceDirectory
+// used to learn the names of the services, until its actual
+// MetaObject is observed.
+var directoryMetaObject = object.FullMetaObject(object.MetaObject{
+	Description: "ServiceDirectory",
+	Methods: map[uint32]object.MetaMethod{
+		100: {
+			Uid:                 100,
+			Name:                "service",
+			ParametersSignature: "(s)",
+			ReturnSignature:     serviceInfoSig,
+		},
+		101: {
+			Uid:                 101,
+			Name:                "services",
+			ParametersSignature: "()",
+			ReturnSignature:     "[" + serviceInfoSig + "]",
+		},
+	},
+})
+
+// maxPayloadText limits the size of the payload descriptions.
+const maxPayloadText = 256
+
+// Annotation describes a message with the names learned by a
+// Resolver.
+type Annotation struct {
+	Service   string // name of the service, empty if unknown
+	Action    string // name of the method, signal or property
+	Signature string // signature of the payload, empty if unknown
+	Payload   string // payload decoded using Signature
+	Err       error  // error decoding the payload
+}
+
+func (a Annotation) String() string {
+	if a.Signature == "" {
+		return ""
+	}
+	name := a.Action
+	if a.Service != "" && a.Action != "" {
+		name = a.Service + "." + a.Action
+	}
+	payload := a.Payload
+	if len(payload) > maxPayloadText {
+		payload = payload[:maxPayloadText] + "..."
+	}
+	if a.Err != nil {
+		payload = fmt.Sprintf("%s (invalid payload: %s)", payload, a.Err)
+	}
+	if name == "" {
+		return fmt.Sprintf("%s %s", a.Signature, payload)
+	}
+	return fmt.Sprintf("%s %s %s", name, a.Signature, payload)
+}
+
+// objectKey designates an object of a service.
+type objectKey struct {
+	service uint32
+	object  uint32
+}
+
+// Resolver learns the names of the services and the MetaObjects of
+// the objects by observing the ServiceDirectory replies and the
+// MetaObject replies. It uses them to name the actions of the
+// messages and to decode their payloads. A Resolver is safe for
+// concurrent use.
+type Resolver struct {
+	mutex    sync.Mutex
+	services map[uint32]string
+	metas    map[objectKey]object.MetaObject
+}
+
+// NewResolver returns a resolver which knows the authentication
+// service and the ServiceDirectory.
+func NewResolver() *Resolver {
+	return &Resolver{
+		services: map[uint32]string{
+			0:                  object.MetaService0.Description,
+			directoryServiceID: directoryMetaObject.Description,
+		},
+		metas: map[objectKey]object.MetaObject{
+			{0, 0}:                                  object.MetaService0,
+			{directoryServiceID, directoryObjectID}: directoryMetaObject,
+		},
+	}
+}
+
+// Resolve names the action of m and decodes its payload. The
+// replies of the ServiceDirectory and the MetaObject replies are
+// learned.
+func (r *Resolver) Resolve(m net.Message) Annotation {
+	return r.annotate(m, true)
+}
+
+// Lookup names the action of m and decodes its payload like Resolve,
+// without learning from m.
+func (r *Resolver) Lookup(m net.Message) Annotation {
+	return r.annotate(m, false)
+}
+
+// annotate implements Resolve and Lookup.
+func (r *Resolver) annotate(m net.Message, learn bool) Annotation {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	hdr := m.Header
+	var a Annotation
+	a.Service = r.services[hdr.Service]
+	meta, ok := r.metas[objectKey{hdr.Service, hdr.Object}]
+	if !ok && hdr.Action < object.MinUserActionID {
+		meta = object.ObjectMetaObject
+	}
+	method, isMethod := meta.Methods[hdr.Action]
+	signal, isSignal := meta.Signals[hdr.Action]
+	property, isProperty := meta.Properties[hdr.Action]
+	switch {
+	case isMethod:
+		a.Action = method.Name
+	case isSignal:
+		a.Action = signal.Name
+	case isProperty:
+		a.Action = property.Name
+	}
+	switch hdr.Type {
+	case net.Call:
+		if isMethod {
+			a.Signature = method.ParametersSignature
+		}
+	case net.Post:
+		if isMethod {
+			a.Signature = method.ParametersSignature
+		} else if isSignal {
+			a.Signature = signal.Signature
+		}
+	case net.Reply:
+		if isMethod {
+			a.Signature = method.ReturnSignature
+		}
+	case net.Event:
+		if isSignal {
+			a.Signature = signal.Signature
+		} else if isProperty {
+			a.Signature = property.Signature
+		}
+	case net.Error:
+		a.Signature = "m"
+	case net.Capability:
+		a.Action, a.Signature = "", "{sm}"
+	case net.Cancel:
+		a.Signature = "I"
+	}
+	if a.Signature == "" {
+		return a
+	}
+	a.Payload, a.Err = FormatPayload(a.Signature, m.Payload)
+	if learn && a.Err == nil && hdr.Type == net.Reply && isMethod {
+		r.learn(hdr, method.Name, a.Signature, m.Payload)
+	}
+	return a
+}
+
+// valid returns true if payload is a value of type sig, see
+// FormatPayload.
+func valid(sig string, payload []byte) bool {
+	_, err := FormatPayload(sig, payload)
+	return err == nil
+}
+
+// learn records the names of the services and the MetaObjects
+// carried by a reply whose payload is a valid value of signature
+// sig. The decoders of qiloop are only used once sig is the signature
+// they expect.
+func (r *Resolver) learn(hdr net.Header, method, sig string, payload []byte) {
+	buf := bytes.NewBuffer(payload)
+	switch {
+	case hdr.Action == object.MetaObjectMethodID:
+		if sig != signature.MetaObjectSignature {
+			return
+		}
+		meta, err := object.ReadMetaObject(buf)
+		if err == nil {
+			r.metas[objectKey{hdr.Service, hdr.Object}] = meta
+		}
+	case hdr.Service != directoryServiceID || hdr.Object != directoryObjectID:
+		return
+	case method == "service":
+		if sig != serviceInfoSig {
+			return
+		}
+		info, err := directory.ReadServiceInfo(buf)
+		if err == nil {
+			r.services[info.ServiceId] = info.Name
+		}
+	case method == "services":
+		if sig != "["+serviceInfoSig+"]" {
+			return
+		}
+		size, err := basic.ReadUint32(buf)
+		for i := uint32(0); err == nil && i < size; i++ {
+			var info directory.ServiceInfo
+			if info, err = directory.ReadServiceInfo(buf); err == nil {
+				r.services[info.ServiceId] = info.Name
+			}
+		}
+	}
+}
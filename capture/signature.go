@@ -0,0 +1,145 @@
+package capture
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BasicKinds are the basic types of the signatures.
+const BasicKinds = "bcCwWiIlLfdsmorvX"
+
+// maxDepth bounds the nesting of the types.
+const maxDepth = 64
+
+// Type is the tree representation of a type signature.
+type Type struct {
+	Kind    byte // basic type, '[', '{', '(', '+' (optional) or '#' (varargs)
+	Members []*Type
+	Name    string   // struct name
+	Fields  []string // struct field names
+}
+
+func (t *Type) String() string {
+	switch t.Kind {
+	case '[':
+		return "[" + t.Members[0].String() + "]"
+	case '{':
+		return "{" + t.Members[0].String() + t.Members[1].String() + "}"
+	case '+', '#':
+		return string(t.Kind) + t.Members[0].String()
+	case '(':
+		var sig strings.Builder
+		sig.WriteString("(")
+		for _, m := range t.Members {
+			sig.WriteString(m.String())
+		}
+		sig.WriteString(")")
+		if t.Name != "" {
+			sig.WriteString("<" + t.Name)
+			for _, f := range t.Fields {
+				sig.WriteString("," + f)
+			}
+			sig.WriteString(">")
+		}
+		return sig.String()
+	default:
+		return string(t.Kind)
+	}
+}
+
+// ParseSignature parses the type signature sig. Unlike the parser of
+// qiloop, it accepts the optionals and the varargs.
+func ParseSignature(sig string) (*Type, error) {
+	t, rest, err := parseType(sig, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid signature: trailing %s", rest)
+	}
+	return t, nil
+}
+
+func parseType(sig string, depth int) (*Type, string, error) {
+	if sig == "" {
+		return nil, sig, fmt.Errorf("unexpected end of signature")
+	}
+	if depth > maxDepth {
+		return nil, sig, fmt.Errorf("types nested too deep")
+	}
+	kind := sig[0]
+	switch {
+	case strings.IndexByte(BasicKinds, kind) != -1:
+		return &Type{Kind: kind}, sig[1:], nil
+	case kind == '+' || kind == '#':
+		elem, rest, err := parseType(sig[1:], depth+1)
+		if err != nil {
+			return nil, rest, err
+		}
+		return &Type{Kind: kind, Members: []*Type{elem}}, rest, nil
+	case kind == '[':
+		elem, rest, err := parseType(sig[1:], depth+1)
+		if err != nil {
+			return nil, rest, err
+		}
+		if !strings.HasPrefix(rest, "]") {
+			return nil, rest, fmt.Errorf("missing ]")
+		}
+		return &Type{Kind: kind, Members: []*Type{elem}}, rest[1:], nil
+	case kind == '{':
+		key, rest, err := parseType(sig[1:], depth+1)
+		if err != nil {
+			return nil, rest, err
+		}
+		elem, rest, err := parseType(rest, depth+1)
+		if err != nil {
+			return nil, rest, err
+		}
+		if !strings.HasPrefix(rest, "}") {
+			return nil, rest, fmt.Errorf("missing }")
+		}
+		return &Type{Kind: kind, Members: []*Type{key, elem}}, rest[1:], nil
+	case kind == '(':
+		t := &Type{Kind: kind}
+		rest := sig[1:]
+		for !strings.HasPrefix(rest, ")") {
+			m, r, err := parseType(rest, depth+1)
+			if err != nil {
+				return nil, r, err
+			}
+			t.Members = append(t.Members, m)
+			rest = r
+		}
+		rest = rest[1:]
+		if !strings.HasPrefix(rest, "<") {
+			return t, rest, nil
+		}
+		annotation, rest, err := parseAnnotation(rest)
+		if err != nil {
+			return nil, rest, err
+		}
+		names := strings.Split(annotation, ",")
+		t.Name, t.Fields = names[0], names[1:]
+		return t, rest, nil
+	default:
+		return nil, sig, fmt.Errorf("unexpected character %q", kind)
+	}
+}
+
+// parseAnnotation returns the content of the struct annotation which
+// starts sig. Nested <> are allowed in the struct name.
+func parseAnnotation(sig string) (string, string, error) {
+	depth := 0
+	for i := 0; i < len(sig); i++ {
+		switch sig[i] {
+		case '<':
+			depth++
+		case '>':
+			depth--
+			if depth == 0 {
+				return sig[1:i], sig[i+1:], nil
+			}
+		}
+	}
+	return "", sig, fmt.Errorf("missing >")
+}
@@ -0,0 +1,69 @@
+package fuzz
+
+import (
+	"bytes"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// Corpus names of the inputs extracted from a capture.
+const (
+	CorpusCapability = "capability" // capability maps
+	CorpusMessage    = "message"    // complete messages
+	CorpusSession    = "session"    // sequences of messages
+	CorpusMetaObject = "metaobject" // MetaObject replies
+	CorpusPayload    = "payload"    // payloads of the messages
+)
+
+// The raw capture of one direction of a connection has the format of
+// a session: use ReadSession to split it into messages.
+
+// isCapabilityMap returns true if the payload is a capability map.
+func isCapabilityMap(payload []byte) bool {
+	buf := bytes.NewBuffer(payload)
+	_, err := bus.ReadCapabilityMap(buf)
+	return err == nil && buf.Len() == 0
+}
+
+// SeedCorpus sorts the messages of a capture by corpus: the
+// capability maps exchanged during the authentication, each message
+// in its serialized form, the payloads of the messages, the
+// MetaObjects received and the whole sequence of messages.
+func SeedCorpus(messages []net.Message) map[string][][]byte {
+	corpus := make(map[string][][]byte)
+	add := func(name string, data []byte) {
+		corpus[name] = append(corpus[name], data)
+	}
+	var session bytes.Buffer
+	for _, m := range messages {
+		var buf bytes.Buffer
+		if err := m.Write(&buf); err != nil {
+			continue
+		}
+		session.Write(buf.Bytes())
+		add(CorpusMessage, buf.Bytes())
+		if len(m.Payload) != 0 {
+			add(CorpusPayload, m.Payload)
+		}
+
+		switch {
+		case m.Header.Type == net.Capability,
+			m.Header.Service == 0 && m.Header.Action == 8:
+			if isCapabilityMap(m.Payload) {
+				add(CorpusCapability, m.Payload)
+			}
+		case m.Header.Type == net.Reply &&
+			m.Header.Action == object.MetaObjectMethodID:
+			_, err := object.ReadMetaObject(bytes.NewBuffer(m.Payload))
+			if err == nil {
+				add(CorpusMetaObject, m.Payload)
+			}
+		}
+	}
+	if session.Len() != 0 {
+		add(CorpusSession, session.Bytes())
+	}
+	return corpus
+}
@@ -0,0 +1,377 @@
+package fuzz
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/bus/session"
+	"github.com/lugu/qiloop/bus/util"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// Client-side fuzzing: a rogue server answers a qiloop client with
+// the messages of a script. The script is a Session: each call (or
+// capability message) of the client consumes the messages of the
+// script up to the next one which is not an event. The events are
+// sent as is, the other messages are sent as the answer to the call.
+
+// clientIdle is the time given to the client to complete its session
+// before the rogue server disconnects it.
+const clientIdle = 200 * time.Millisecond
+
+// Failures of the client.
+var (
+	errClientHang = errors.New("client hang")
+	errClientLeak = errors.New("client goroutine leak")
+)
+
+// rogueServer answers the messages of the clients with the messages
+// of a script.
+type rogueServer struct {
+	listener  net.Listener
+	mutex     sync.Mutex
+	script    Session
+	endpoints []net.EndPoint
+	meta      object.MetaObject // learned from the script
+	oversized error             // answer skipped by the server
+}
+
+func newRogueServer(addr string, script Session) (*rogueServer, error) {
+	listener, err := net.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &rogueServer{
+		listener: listener,
+		script:   script,
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *rogueServer) serve() {
+	for {
+		stream, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		endpoint := net.NewEndPoint(stream)
+		s.mutex.Lock()
+		s.endpoints = append(s.endpoints, endpoint)
+		s.mutex.Unlock()
+		s.handle(endpoint)
+	}
+}
+
+// next pops the next message of the script.
+func (s *rogueServer) next() (net.Message, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.script) == 0 {
+		return net.Message{}, false
+	}
+	m := s.script[0]
+	s.script = s.script[1:]
+	return m, true
+}
+
+// signature returns the signature of the payload of m sent in
+// response to call, or an empty string if it is not known.
+func (s *rogueServer) signature(call net.Header, m net.Message) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case m.Header.Type == net.Error:
+		return "m"
+	case m.Header.Type == net.Capability:
+		return "{sm}"
+	case m.Header.Type == net.Event:
+		if signal, ok := s.meta.Signals[m.Header.Action]; ok {
+			return signal.Signature
+		}
+		return ""
+	case m.Header.Type != net.Reply:
+		return ""
+	case call.Service == 0 && call.Action == object.AuthenticateActionID:
+		return "{sm}"
+	case call.Action == object.MetaObjectMethodID:
+		return metaObjectSignature
+	}
+	if method, ok := s.meta.Methods[call.Action]; ok {
+		return method.ReturnSignature
+	}
+	return ""
+}
+
+// check returns an error if the client would exhaust its memory
+// decoding m sent in response to call. It learns the MetaObject
+// received by the client.
+func (s *rogueServer) check(call net.Header, m net.Message) error {
+	sig := s.signature(call, m)
+	if sig == "" {
+		return nil
+	}
+	if err := checkPayload(sig, m.Payload); err != nil {
+		s.mutex.Lock()
+		s.oversized = err
+		s.mutex.Unlock()
+		return err
+	}
+	if sig == metaObjectSignature {
+		meta, err := object.ReadMetaObject(bytes.NewBuffer(m.Payload))
+		if err == nil {
+			s.mutex.Lock()
+			s.meta = meta
+			s.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+// Oversized returns the error of the answer skipped because the
+// client would have exhausted its memory decoding it.
+func (s *rogueServer) Oversized() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.oversized
+}
+
+func (s *rogueServer) handle(endpoint net.EndPoint) {
+	filter := func(hdr *net.Header) (matched bool, keep bool) {
+		return hdr.Type == net.Call || hdr.Type == net.Capability, true
+	}
+	consumer := func(msg *net.Message) error {
+		for {
+			m, ok := s.next()
+			if !ok {
+				// end of the script
+				return endpoint.Close()
+			}
+			if err := s.check(msg.Header, m); err != nil {
+				return endpoint.Close()
+			}
+			recordMessage(m.Header.Type, m.Payload)
+			if m.Header.Type == net.Event {
+				if err := endpoint.Send(m); err != nil {
+					return err
+				}
+				continue
+			}
+			hdr := net.NewHeader(m.Header.Type, msg.Header.Service,
+				msg.Header.Object, msg.Header.Action, msg.Header.ID)
+			hdr.Flags = m.Header.Flags
+			return endpoint.Send(net.NewMessage(hdr, m.Payload))
+		}
+	}
+	endpoint.AddHandler(filter, consumer, nil)
+}
+
+// Close stops listening and disconnects the clients.
+func (s *rogueServer) Close() {
+	s.listener.Close()
+	// the handlers of the endpoints use the mutex: do not hold it
+	// while closing them.
+	s.mutex.Lock()
+	endpoints := s.endpoints
+	s.endpoints = nil
+	s.mutex.Unlock()
+	for _, endpoint := range endpoints {
+		endpoint.Close()
+	}
+}
+
+// runClient opens a session with the server listening on addr and
+// uses the ServiceDirectory proxy of the session.
+func runClient(addr string) error {
+	sess, err := session.NewAuthSession(addr, currentTarget().User, currentTarget().Token)
+	if err != nil {
+		return err
+	}
+	defer sess.Terminate()
+	directory := sess.(*session.Session).Directory
+	if _, err = directory.Services(); err != nil {
+		return err
+	}
+	if _, err = directory.Service("ServiceDirectory"); err != nil {
+		return err
+	}
+	_, err = directory.MachineId()
+	return err
+}
+
+// clientLabel is the pprof label of the goroutines of a client: the
+// goroutines started by the client inherit it, the other goroutines
+// of the process are not counted.
+const clientLabel = "fuzz-client"
+
+// clientCount numbers the clients in order to label them.
+var clientCount uint64
+
+// goroutineCountExp matches the header of a stack of the goroutine
+// profile: the number of goroutines sharing the stack.
+var goroutineCountExp = regexp.MustCompile(`^(\d+) @`)
+
+// clientGoroutines returns the number of goroutines labelled with
+// the client id.
+func clientGoroutines(id string) int {
+	var profile bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&profile, 1)
+	label := fmt.Sprintf("%q:%q", clientLabel, id)
+	total, count := 0, 0
+	for _, line := range strings.Split(profile.String(), "\n") {
+		if m := goroutineCountExp.FindStringSubmatch(line); m != nil {
+			count, _ = strconv.Atoi(m[1])
+		} else if strings.HasPrefix(line, "# labels: ") &&
+			strings.Contains(line, label) {
+			total += count
+		}
+	}
+	return total
+}
+
+// waitGoroutines waits until the goroutines of the client id exit.
+// Returns false if they do not before the timeout.
+func waitGoroutines(id string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for clientGoroutines(id) != 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// RunClient runs a qiloop client against a rogue server answering
+// with the messages of script. It returns true if the client
+// completed its session. It returns an error if the client does not
+// return once disconnected or if its goroutines outlive the session.
+// The server disconnects the client instead of sending an answer
+// which would exhaust its memory: RunClient returns errOversized in
+// this case.
+func RunClient(script Session) (bool, error) {
+	timeout := time.Duration(currentTarget().CallTimeout)
+	id := strconv.FormatUint(atomic.AddUint64(&clientCount, 1), 10)
+
+	addr := util.NewUnixAddr()
+	server, err := newRogueServer(addr, script)
+	if err != nil {
+		return false, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		labels := pprof.Labels(clientLabel, id)
+		pprof.Do(context.Background(), labels, func(context.Context) {
+			done <- runClient(addr)
+		})
+	}()
+
+	var clientErr error
+	select {
+	case clientErr = <-done:
+		server.Close()
+	case <-time.After(clientIdle):
+		// the client waits for an answer which will never
+		// come: it shall give up once disconnected.
+		server.Close()
+		select {
+		case clientErr = <-done:
+		case <-time.After(timeout):
+			return false, errClientHang
+		}
+	}
+	if err := server.Oversized(); err != nil {
+		waitGoroutines(id, timeout)
+		return false, err
+	}
+	if !waitGoroutines(id, timeout) {
+		return clientErr == nil, fmt.Errorf("%w: %d goroutines left",
+			errClientLeak, clientGoroutines(id))
+	}
+	return clientErr == nil, nil
+}
+
+// FuzzClient interprets data as the script of a rogue server and
+// runs a client against it. It panics if the client hangs, leaks
+// goroutines or receives an answer which would exhaust its memory.
+func FuzzClient(data []byte) int {
+	script, err := ReadSession(bytes.NewBuffer(data))
+	if err != nil || len(script) == 0 {
+		return -1
+	}
+	ok, err := RunClient(script)
+	if errors.Is(err, errOversized) && skipOversized(err) {
+		return -1
+	}
+	if err != nil {
+		panic(err.Error())
+	}
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// RecordScript runs the client against the target through a relay
+// and records the messages sent by the target: they form the script
+// of a rogue server behaving like the target.
+func RecordScript() (Session, error) {
+	addr := util.NewUnixAddr()
+	listener, err := net.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	var mutex sync.Mutex
+	script := make(Session, 0)
+	endpoints := make(chan []net.EndPoint, 1)
+	go func() {
+		stream, err := listener.Accept()
+		if err != nil {
+			endpoints <- nil
+			return
+		}
+		client := net.NewEndPoint(stream)
+		server, err := currentTarget().dial()
+		if err != nil {
+			client.Close()
+			endpoints <- nil
+			return
+		}
+		all := func(hdr *net.Header) (matched bool, keep bool) {
+			return true, true
+		}
+		client.AddHandler(all, func(msg *net.Message) error {
+			return server.Send(*msg)
+		}, nil)
+		server.AddHandler(all, func(msg *net.Message) error {
+			mutex.Lock()
+			script = append(script, *msg)
+			mutex.Unlock()
+			return client.Send(*msg)
+		}, nil)
+		endpoints <- []net.EndPoint{client, server}
+	}()
+
+	err = runClient(addr)
+	for _, endpoint := range <-endpoints {
+		endpoint.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return script, nil
+}
@@ -0,0 +1,275 @@
+package fuzz
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// ddmin implements the delta debugging algorithm: it returns a
+// minimal subset of the indexes 0..n-1 for which test returns true.
+// test must return true for the complete set.
+func ddmin(n int, test func(keep []int) bool) []int {
+	keep := make([]int, n)
+	for i := range keep {
+		keep[i] = i
+	}
+	chunks := 2
+	for len(keep) >= 2 {
+		size := (len(keep) + chunks - 1) / chunks
+		reduced := false
+		for start := 0; start < len(keep); start += size {
+			end := start + size
+			if end > len(keep) {
+				end = len(keep)
+			}
+			// try the complement of the chunk.
+			complement := make([]int, 0, len(keep)-(end-start))
+			complement = append(complement, keep[:start]...)
+			complement = append(complement, keep[end:]...)
+			if test(complement) {
+				keep = complement
+				if chunks > 2 {
+					chunks--
+				}
+				reduced = true
+				break
+			}
+		}
+		if reduced {
+			continue
+		}
+		if chunks >= len(keep) {
+			break
+		}
+		chunks *= 2
+		if chunks > len(keep) {
+			chunks = len(keep)
+		}
+	}
+	if len(keep) == 1 && test([]int{}) {
+		return []int{}
+	}
+	return keep
+}
+
+// canonical returns the representation of a capability map with its
+// keys sorted or data itself if it is not a capability map: two
+// identical maps have the same representation.
+func canonical(data []byte) []byte {
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(data))
+	if err != nil {
+		return data
+	}
+	return sortedCapabilityMap(cm)
+}
+
+func sortedCapabilityMap(cm bus.CapabilityMap) []byte {
+	var buf bytes.Buffer
+	WriteSortedCapabilityMap(cm, &buf)
+	return buf.Bytes()
+}
+
+// Behaviour summarizes how the target reacts to data sent as an
+// authentication request. Two inputs with the same behaviour are
+// considered redundant. Since the reply of the server only tells if
+// the authentication succeeded, the behaviour also describes how the
+// server decodes the request: the error returned by the decoder or
+// the types of the values of the map.
+func Behaviour(data []byte) string {
+	return reply(data) + "; request: " + request(data)
+}
+
+// reply describes the response of the target to an authentication
+// request.
+func reply(data []byte) string {
+	response, err := callAuthenticate(data)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(response))
+	if err != nil {
+		return "invalid response: " + err.Error()
+	}
+	keys := make([]string, 0, len(cm))
+	for k, v := range cm {
+		if k == bus.KeyState {
+			k = fmt.Sprintf("%s=%v", k, v)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return "reply: " + strings.Join(keys, ",")
+}
+
+// request describes how an authentication request is decoded: the
+// error of the decoder without its numbers, or the distinct
+// signatures of the values. The signatures of the credentials are
+// kept apart since the server inspects them.
+func request(data []byte) string {
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(data))
+	if err != nil {
+		return "invalid: " + digitsExp.ReplaceAllString(err.Error(), "N")
+	}
+	seen := make(map[string]bool)
+	for k, v := range cm {
+		sig := v.Signature()
+		if k == bus.KeyUser || k == bus.KeyToken || k == bus.KeyState {
+			sig = k + "=" + sig
+		}
+		seen[sig] = true
+	}
+	signatures := make([]string, 0, len(seen))
+	for sig := range seen {
+		signatures = append(signatures, sig)
+	}
+	sort.Strings(signatures)
+	return "values: " + strings.Join(signatures, ",")
+}
+
+// minimizeValue returns a smaller value which does not change the
+// behaviour of the map.
+func minimizeValue(cm bus.CapabilityMap, key, behaviour string) value.Value {
+	v := cm[key]
+	test := func(candidate value.Value) bool {
+		cm[key] = candidate
+		var buf bytes.Buffer
+		if err := bus.WriteCapabilityMap(cm, &buf); err != nil {
+			return false
+		}
+		return Behaviour(buf.Bytes()) == behaviour
+	}
+	var minimal value.Value
+	switch x := v.(type) {
+	case value.StringValue:
+		s := []byte(x.Value())
+		keep := ddmin(len(s), func(keep []int) bool {
+			return test(value.String(string(pick(s, keep))))
+		})
+		minimal = value.String(string(pick(s, keep)))
+	case value.ListValue:
+		l := x.Value()
+		keep := ddmin(len(l), func(keep []int) bool {
+			return test(value.List(pickValues(l, keep)))
+		})
+		minimal = value.List(pickValues(l, keep))
+	default:
+		data := value.Bytes(v)
+		keep := ddmin(len(data), func(keep []int) bool {
+			return test(value.Opaque(v.Signature(), pick(data, keep)))
+		})
+		minimal = value.Opaque(v.Signature(), pick(data, keep))
+	}
+	if !test(minimal) {
+		minimal = v
+	}
+	cm[key] = minimal
+	return minimal
+}
+
+func pick(data []byte, keep []int) []byte {
+	out := make([]byte, len(keep))
+	for i, k := range keep {
+		out[i] = data[k]
+	}
+	return out
+}
+
+func pickValues(values []value.Value, keep []int) []value.Value {
+	out := make([]value.Value, len(keep))
+	for i, k := range keep {
+		out[i] = values[k]
+	}
+	return out
+}
+
+// MinimizeCapabilityMap returns a smaller input with the same
+// behaviour: the entries of the capability map are removed with
+// delta debugging, then the bytes of each remaining value. Inputs
+// which are not a capability map are minimized byte per byte.
+func MinimizeCapabilityMap(data []byte) []byte {
+	behaviour := Behaviour(data)
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(data))
+	if err != nil {
+		keep := ddmin(len(data), func(keep []int) bool {
+			return Behaviour(pick(data, keep)) == behaviour
+		})
+		return pick(data, keep)
+	}
+
+	keys := make([]string, 0, len(cm))
+	for k := range cm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	subset := func(keep []int) bus.CapabilityMap {
+		m := make(bus.CapabilityMap, len(keep))
+		for _, i := range keep {
+			m[keys[i]] = cm[keys[i]]
+		}
+		return m
+	}
+	keep := ddmin(len(keys), func(keep []int) bool {
+		return Behaviour(sortedCapabilityMap(subset(keep))) == behaviour
+	})
+	minimal := subset(keep)
+	for _, i := range keep {
+		minimizeValue(minimal, keys[i], behaviour)
+	}
+	return sortedCapabilityMap(minimal)
+}
+
+// MergeCorpora copies into out the inputs of the corpus directories
+// which add a new behaviour. Inputs representing the same capability
+// map are copied only once. Returns the number of inputs copied and
+// dropped.
+func MergeCorpora(dirs []string, out string) (kept, dropped int, err error) {
+	if err = os.MkdirAll(out, 0755); err != nil {
+		return 0, 0, err
+	}
+	seen := make(map[string]bool)
+	behaviours := make(map[string]bool)
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return kept, dropped, err
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return kept, dropped, err
+			}
+			sum := sha1.Sum(canonical(data))
+			hash := hex.EncodeToString(sum[:])
+			if seen[hash] {
+				dropped++
+				continue
+			}
+			seen[hash] = true
+			behaviour := Behaviour(data)
+			if behaviours[behaviour] {
+				dropped++
+				continue
+			}
+			behaviours[behaviour] = true
+			filename := filepath.Join(out, hash+".bin")
+			if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+				return kept, dropped, err
+			}
+			kept++
+		}
+	}
+	return kept, dropped, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/lugu/audit/fuzz"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s minimize [-d dir] files...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s merge [-d dir] corpus...\n", os.Args[0])
+	os.Exit(2)
+}
+
+func minimize(args []string) {
+	flags := flag.NewFlagSet("minimize", flag.ExitOnError)
+	dir := flags.String("d", "minimized", "output directory")
+	flags.Parse(args)
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatalf("%s", err)
+	}
+	for _, filename := range flags.Args() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		minimal := fuzz.MinimizeCapabilityMap(data)
+		out := filepath.Join(*dir, filepath.Base(filename))
+		if err := ioutil.WriteFile(out, minimal, 0644); err != nil {
+			log.Fatalf("%s", err)
+		}
+		fmt.Printf("%s: %d -> %d bytes\n", filename, len(data),
+			len(minimal))
+	}
+}
+
+func merge(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	dir := flags.String("d", "merged", "output directory")
+	flags.Parse(args)
+
+	kept, dropped, err := fuzz.MergeCorpora(flags.Args(), *dir)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	fmt.Printf("%d input(s) kept, %d dropped\n", kept, dropped)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "minimize":
+		minimize(os.Args[2:])
+	case "merge":
+		merge(os.Args[2:])
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,58 @@
+package fuzz
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime/coverage"
+	"strconv"
+)
+
+// Coverage of the in-process server: the binary shall be built with
+// -cover in atomic mode and -coverpkg listing its main package and
+// the qiloop packages of interest, for example:
+//
+//	go build -cover -covermode=atomic \
+//		-coverpkg=./fuzz/service,github.com/lugu/qiloop/... ./fuzz/service
+
+// WriteCoverage writes the coverage counters of the process in dir.
+// It returns an error if the binary is not built with -cover.
+func WriteCoverage(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := coverage.WriteMetaDir(dir); err != nil {
+		return err
+	}
+	return coverage.WriteCountersDir(dir)
+}
+
+var percentExp = regexp.MustCompile(`^\s*(\S+)\s+coverage: ([0-9.]+)% of statements`)
+
+// ReadCoverage returns the statement coverage of each package
+// recorded in dir. It uses the covdata tool of the Go toolchain.
+func ReadCoverage(dir string) (map[string]float64, error) {
+	output, err := exec.Command("go", "tool", "covdata", "percent",
+		"-i", dir).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("covdata: %s: %s", err,
+			bytes.TrimSpace(output))
+	}
+	coverage := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		m := percentExp.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		percent, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			return nil, err
+		}
+		coverage[m[1]] = percent
+	}
+	return coverage, scanner.Err()
+}
@@ -0,0 +1,216 @@
+package fuzz
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	gofuzz "github.com/google/gofuzz"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// capEntry is an entry of a serialized capability map. Unlike
+// bus.CapabilityMap, a list of entries can hold the same key twice.
+type capEntry struct {
+	key   string
+	value value.Value
+}
+
+// writeCapEntries serializes the entries like a capability map.
+func writeCapEntries(entries []capEntry, w io.Writer) error {
+	if err := basic.WriteUint32(uint32(len(entries)), w); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := basic.WriteString(e.key, w); err != nil {
+			return err
+		}
+		if err := e.value.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credentialRequest is the input of makeCredential: the entries of
+// an authentic capability map to be mutated.
+type credentialRequest struct {
+	entries []capEntry
+}
+
+// lookup returns the index of the first entry with key, or -1.
+func (r *credentialRequest) lookup(key string) int {
+	for i, e := range r.entries {
+		if e.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// set replaces the value of key, or adds it.
+func (r *credentialRequest) set(key string, v value.Value) {
+	if i := r.lookup(key); i != -1 {
+		r.entries[i].value = v
+		return
+	}
+	r.entries = append(r.entries, capEntry{key, v})
+}
+
+// credential returns the string value of key, or a default one.
+func (r *credentialRequest) credential(key string) string {
+	if i := r.lookup(key); i != -1 {
+		if s, ok := r.entries[i].value.(value.StringValue); ok {
+			return string(s)
+		}
+	}
+	return "nao"
+}
+
+// makeCredential mutates the authentication fields of a capability
+// map: the type and the size of the credentials, missing and
+// duplicated keys, look-alike keys as well as the state and new
+// token keys used by the server.
+func makeCredential(r *credentialRequest, c gofuzz.Continue) {
+	credentials := []string{bus.KeyUser, bus.KeyToken}
+	mutations := 1 + c.Intn(3)
+	for i := 0; i < mutations; i++ {
+		key := credentials[c.Intn(len(credentials))]
+		switch c.Intn(7) {
+		case 0, 1:
+			r.set(key, makeCredentialValue(r.credential(key), c))
+		case 2:
+			// missing key
+			if i := r.lookup(key); i != -1 {
+				r.entries = append(r.entries[:i], r.entries[i+1:]...)
+			}
+		case 3:
+			// duplicated key, before or after the authentic one
+			e := capEntry{key, makeCredentialValue(r.credential(key), c)}
+			pos := c.Intn(len(r.entries) + 1)
+			r.entries = append(r.entries[:pos],
+				append([]capEntry{e}, r.entries[pos:]...)...)
+		case 4:
+			r.set(bus.KeyState, makeStateValue(c))
+		case 5:
+			r.set(bus.KeyNewToken,
+				makeCredentialValue(r.credential(bus.KeyToken), c))
+		case 6:
+			// look-alike key
+			if i := r.lookup(key); i != -1 {
+				r.entries[i].key = makeLookAlike(key, c)
+			}
+		}
+	}
+}
+
+// makeCredentialValue returns s or a variation of s: other string,
+// huge string, other type, list, map, struct or embedded value.
+func makeCredentialValue(s string, c gofuzz.Continue) value.Value {
+	switch c.Intn(10) {
+	case 0:
+		return value.String(s)
+	case 1:
+		var other string
+		c.Fuzz(&other)
+		return value.String(other)
+	case 2:
+		return value.String("")
+	case 3:
+		if s == "" {
+			s = "A"
+		}
+		size := 1<<16 + c.Intn(1<<20)
+		return value.String(strings.Repeat(s, size/len(s)+1)[:size])
+	case 4:
+		return value.String(s + "\x00" + cleanName(c))
+	case 5:
+		// any type but a string
+		var v value.Value
+		for {
+			makeValue(&v, c)
+			if v.Signature() != "s" {
+				return v
+			}
+		}
+	case 6:
+		list := []value.Value{value.String(s)}
+		for i := c.Intn(3); i > 0; i-- {
+			list = append(list, makeCredentialValue(s, c))
+		}
+		return value.List(list)
+	case 7:
+		var buf bytes.Buffer
+		writeCapEntries([]capEntry{{s, value.String(s)}}, &buf)
+		return value.Opaque("{sm}", buf.Bytes())
+	case 8:
+		var buf bytes.Buffer
+		value.String(s).Write(&buf)
+		return value.Opaque("m", buf.Bytes())
+	default:
+		return value.Opaque("(s)<Credential,value>", value.Bytes(value.String(s)))
+	}
+}
+
+// makeStateValue returns an authentication state of various types.
+func makeStateValue(c gofuzz.Continue) value.Value {
+	states := []uint32{bus.StateError, bus.StateContinue, bus.StateDone,
+		0, 4, 0xffffffff}
+	state := states[c.Intn(len(states))]
+	switch c.Intn(5) {
+	case 0:
+		return value.Int(int32(state))
+	case 1:
+		return value.Uint8(uint8(state))
+	case 2:
+		return value.Long(int64(state))
+	case 3:
+		return value.String(string(rune('0' + state%10)))
+	default:
+		return value.Uint(state)
+	}
+}
+
+// makeLookAlike returns a key close to key.
+func makeLookAlike(key string, c gofuzz.Continue) string {
+	switch c.Intn(5) {
+	case 0:
+		return strings.ToUpper(key)
+	case 1:
+		return key + "\x00"
+	case 2:
+		return " " + key
+	case 3:
+		return strings.Replace(key, "_", "-", -1)
+	default:
+		return key[:len(key)-1]
+	}
+}
+
+// MutateCredentials returns cm serialized with its authentication
+// fields mutated.
+func (g *Generator) MutateCredentials(cm bus.CapabilityMap) []byte {
+	keys := make([]string, 0, len(cm))
+	for k := range cm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := credentialRequest{entries: make([]capEntry, len(keys))}
+	for i, k := range keys {
+		r.entries[i] = capEntry{k, cm[k]}
+	}
+	g.fuzzer.Fuzz(&r)
+	var buf bytes.Buffer
+	writeCapEntries(r.entries, &buf)
+	return buf.Bytes()
+}
+
+// MutateCredentials mutates cm using the default generator.
+func MutateCredentials(cm bus.CapabilityMap) []byte {
+	generatorMutex.Lock()
+	defer generatorMutex.Unlock()
+	return generator.MutateCredentials(cm)
+}
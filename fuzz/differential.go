@@ -0,0 +1,245 @@
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// compareValues returns an error describing the first difference
+// between a and b. Lists are compared element by element, the
+// content of the other values is decoded following their signature
+// and compared with compareContent.
+func compareValues(path string, a, b value.Value) error {
+	if a.Signature() != b.Signature() {
+		return fmt.Errorf("%s: signature %q became %q", path,
+			a.Signature(), b.Signature())
+	}
+	la, okA := a.(value.ListValue)
+	lb, okB := b.(value.ListValue)
+	if okA && okB {
+		if len(la) != len(lb) {
+			return fmt.Errorf("%s: %d elements became %d", path,
+				len(la), len(lb))
+		}
+		for i := range la {
+			err := compareValues(fmt.Sprintf("%s[%d]", path, i),
+				la[i], lb[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if okA != okB {
+		return fmt.Errorf("%s: list decoded as %T", path, b)
+	}
+	da, db := value.Bytes(a), value.Bytes(b)
+	t, err := capture.ParseSignature(a.Signature())
+	if err != nil {
+		// not supported by the parser: compare the bytes.
+		if !bytes.Equal(da, db) {
+			return fmt.Errorf("%s (%s): content %x became %x", path,
+				a.Signature(), da, db)
+		}
+		return nil
+	}
+	ra, rb := bytes.NewReader(da), bytes.NewReader(db)
+	if err := compareContent(path, t, ra, rb); err != nil {
+		return err
+	}
+	if ra.Len() != 0 || rb.Len() != 0 {
+		return fmt.Errorf("%s (%s): %d trailing bytes became %d", path,
+			a.Signature(), ra.Len(), rb.Len())
+	}
+	return nil
+}
+
+// basicSizes are the sizes of the basic types of fixed size.
+var basicSizes = map[byte]int{
+	'b': 1, 'c': 1, 'C': 1, 'w': 2, 'W': 2, 'i': 4, 'I': 4, 'f': 4,
+	'l': 8, 'L': 8, 'd': 8, 'v': 0,
+}
+
+// compareContent decodes a value of type t from ra and rb and returns
+// an error describing the first difference. The embedded values and
+// object references are decoded before being compared.
+func compareContent(path string, t *capture.Type, ra, rb io.Reader) error {
+	invalid := func(err error) error {
+		return fmt.Errorf("%s (%s): invalid content: %s", path, t, err)
+	}
+	if size, ok := basicSizes[t.Kind]; ok {
+		da, db := make([]byte, size), make([]byte, size)
+		if _, err := io.ReadFull(ra, da); err != nil {
+			return invalid(err)
+		}
+		if _, err := io.ReadFull(rb, db); err != nil {
+			return invalid(err)
+		}
+		if !bytes.Equal(da, db) {
+			return fmt.Errorf("%s (%s): content %x became %x", path,
+				t, da, db)
+		}
+		return nil
+	}
+	switch t.Kind {
+	case 's', 'r':
+		sa, err := basic.ReadString(ra)
+		if err != nil {
+			return invalid(err)
+		}
+		sb, err := basic.ReadString(rb)
+		if err != nil {
+			return invalid(err)
+		}
+		if sa != sb {
+			return fmt.Errorf("%s (%s): content %q became %q", path,
+				t, sa, sb)
+		}
+	case 'm', 'X':
+		va, err := value.NewValue(ra)
+		if err != nil {
+			return invalid(err)
+		}
+		vb, err := value.NewValue(rb)
+		if err != nil {
+			return invalid(err)
+		}
+		return compareValues(path+".value", va, vb)
+	case 'o':
+		oa, err := object.ReadObjectReference(ra)
+		if err != nil {
+			return invalid(err)
+		}
+		ob, err := object.ReadObjectReference(rb)
+		if err != nil {
+			return invalid(err)
+		}
+		if !reflect.DeepEqual(oa, ob) {
+			return fmt.Errorf("%s (%s): object %v became %v", path,
+				t, oa, ob)
+		}
+	case '+':
+		pa, err := basic.ReadBool(ra)
+		if err != nil {
+			return invalid(err)
+		}
+		pb, err := basic.ReadBool(rb)
+		if err != nil {
+			return invalid(err)
+		}
+		if pa != pb {
+			return fmt.Errorf("%s (%s): presence %v became %v", path,
+				t, pa, pb)
+		}
+		if pa {
+			return compareContent(path, t.Members[0], ra, rb)
+		}
+	case '[', '{', '#':
+		na, err := basic.ReadUint32(ra)
+		if err != nil {
+			return invalid(err)
+		}
+		nb, err := basic.ReadUint32(rb)
+		if err != nil {
+			return invalid(err)
+		}
+		if na != nb {
+			return fmt.Errorf("%s: %d elements became %d", path,
+				na, nb)
+		}
+		for i := 0; i < int(na); i++ {
+			for j, m := range t.Members {
+				elem := fmt.Sprintf("%s[%d]", path, i)
+				if t.Kind == '{' {
+					elem += []string{".key", ".value"}[j]
+				}
+				if err := compareContent(elem, m, ra, rb); err != nil {
+					return err
+				}
+			}
+		}
+	case '(':
+		for i, m := range t.Members {
+			field := fmt.Sprintf("%d", i)
+			if i < len(t.Fields) {
+				field = t.Fields[i]
+			}
+			err := compareContent(path+"."+field, m, ra, rb)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CompareCapabilityMaps returns an error describing the first
+// difference between a and b.
+func CompareCapabilityMaps(a, b bus.CapabilityMap) error {
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vb, ok := b[k]
+		if !ok {
+			return fmt.Errorf("%q: missing key", k)
+		}
+		if err := compareValues(fmt.Sprintf("%q", k), a[k], vb); err != nil {
+			return err
+		}
+	}
+	if len(a) != len(b) {
+		return fmt.Errorf("%d entries became %d", len(a), len(b))
+	}
+	return nil
+}
+
+// RoundTrip reads a capability map from data, writes it and reads it
+// again. It returns an error if the second map differs from the
+// first one: the encoder and the decoder are not symmetric.
+func RoundTrip(data []byte) (bus.CapabilityMap, error) {
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err = bus.WriteCapabilityMap(cm, &out); err != nil {
+		return cm, fmt.Errorf("asymmetry: write failed: %s", err)
+	}
+	cm2, err := bus.ReadCapabilityMap(&out)
+	if err != nil {
+		return cm, fmt.Errorf("asymmetry: read after write failed: %s", err)
+	}
+	if out.Len() != 0 {
+		return cm, fmt.Errorf("asymmetry: %d bytes not read", out.Len())
+	}
+	if err = CompareCapabilityMaps(cm, cm2); err != nil {
+		return cm, fmt.Errorf("asymmetry: %s", err)
+	}
+	return cm, nil
+}
+
+// FuzzRoundTrip is the differential version of FuzzSerializer: it
+// panics if the capability map decoded from data changes after being
+// encoded.
+func FuzzRoundTrip(data []byte) int {
+	cm, err := RoundTrip(data)
+	if cm == nil {
+		return 0
+	}
+	if err != nil {
+		panic(err.Error())
+	}
+	return 1
+}
@@ -3,7 +3,12 @@ package fuzz
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/lugu/qiloop/bus"
@@ -12,29 +17,69 @@ import (
 	"github.com/lugu/qiloop/bus/util"
 )
 
-var serverURL string = "tcps://localhost:9503"
+var (
+	targetMutex sync.Mutex
+	target      Target
+	// inProcessURL is the address of the in-process server, empty
+	// until it is started.
+	inProcessURL string
+)
 
 func init() {
-	serverURL = util.NewUnixAddr()
-	server, err := dir.NewServer(serverURL, bus.Dictionary(
+	var err error
+	target, err = LoadTarget()
+	if err != nil {
+		log.Fatalf("Target: %s", err)
+	}
+}
+
+// startServer starts the in-process server and returns its address.
+func startServer(user, token string) string {
+	addr := util.NewUnixAddr()
+	server, err := dir.NewServer(addr, bus.Dictionary(
 		map[string]string{
-			"nao": "nao",
+			user: token,
 		},
 	))
+	if err != nil {
+		log.Fatalf("Server: %s", err)
+	}
 
 	go func() {
-		err = <-server.WaitTerminate()
+		err := <-server.WaitTerminate()
 		if err != nil {
 			log.Fatalf("Server: failed with error %s", err)
 		}
 	}()
+	return addr
+}
+
+// currentTarget returns the target being fuzzed. The in-process
+// server is started the first time a target without URL is used.
+func currentTarget() Target {
+	targetMutex.Lock()
+	defer targetMutex.Unlock()
+	if target.URL == "" {
+		if inProcessURL == "" {
+			inProcessURL = startServer(target.User, target.Token)
+		}
+		target.URL = inProcessURL
+	}
+	return target
 }
 
 func FuzzSerializer(data []byte) int {
+	ret, _, _ := fuzzSerializer(data)
+	return ret
+}
+
+// fuzzSerializer implements FuzzSerializer and returns the capability
+// map decoded or the error of the decoder.
+func fuzzSerializer(data []byte) (int, bus.CapabilityMap, error) {
 	buf := bytes.NewBuffer(data)
 	cm, err := bus.ReadCapabilityMap(buf)
 	if err != nil {
-		return 0
+		return 0, nil, err
 	}
 
 	var out bytes.Buffer
@@ -42,30 +87,163 @@ func FuzzSerializer(data []byte) int {
 	if err != nil {
 		panic(err)
 	}
-	return 1
+	return 1, cm, nil
 }
 
-func Fuzz(data []byte) int {
+// pingGateway verifies the server still accepts connections and
+// authenticates users within the health-check timeout. A new
+// connection is opened for each check and closed afterwards: the
+// result does not depend on the connections used by the inputs.
+func pingGateway() error {
+	t := currentTarget()
+	ch := make(chan error, 1)
+
+	go func() {
+		endpoint, err := t.dial()
+		if err != nil {
+			ch <- errors.New("gateway has crashed")
+			return
+		}
+		defer endpoint.Close()
+		err = bus.AuthenticateUser(endpoint, t.User, t.Token)
+		if err != nil {
+			ch <- errors.New("gateway is broken")
+			return
+		}
+		ch <- nil
+	}()
+
+	timer := time.NewTimer(time.Duration(t.HealthTimeout))
+	select {
+	case err := <-ch:
+		timer.Stop()
+		return err
+	case <-timer.C:
+		return errTimeout
+	}
+}
+
+// checkGateway panics if the server is not able to authenticate a
+// client within the health-check timeout.
+func checkGateway() {
+	if err := pingGateway(); err != nil {
+		panic(err)
+	}
+}
+
+// FuzzMessage writes data straight onto the socket: the first 28
+// bytes are interpreted as the header of the message (magic, ID,
+// size, version, type, flags, service, object, action) and the rest
+// as the payload.
+func FuzzMessage(data []byte) int {
+	ret, _ := fuzzMessage(data)
+	return ret
+}
+
+// exchange is the outcome of a message written on the socket.
+type exchange struct {
+	written error       // error writing the message
+	answer  net.Message // message sent back by the server
+	read    error       // error reading the header of the answer
+}
+
+// fuzzMessage implements FuzzMessage and returns the answer of the
+// server.
+func fuzzMessage(data []byte) (int, exchange) {
+	timeout := time.Duration(currentTarget().CallTimeout)
+	// the server does not answer to most messages: do not wait
+	// for too long.
+	const replyTimeout = 200 * time.Millisecond
+
+	var x exchange
+	if len(data) < net.HeaderSize {
+		return -1, x
+	}
+
+	conn, err := currentTarget().dialConn()
+	if err != nil {
+		panic("gateway has crashed")
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+
+	var sent net.Header
+	if sent.Read(bytes.NewReader(data)) == nil {
+		recordMessage(sent.Type, data[net.HeaderSize:])
+	}
+	start := time.Now()
+	_, x.written = conn.Write(data)
+	if x.written != nil {
+		conn.Close()
+		checkGateway()
+		return 0, x
+	}
+
+	// wait for a response or for the server to close the
+	// connection.
+	conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	x.read = x.answer.Header.Read(conn)
+	if x.read == nil {
+		recordLatency(time.Since(start))
+		// the payload is read as it comes: the size announced
+		// by the server is not allocated upfront.
+		x.answer.Payload, _ = ioutil.ReadAll(io.LimitReader(conn,
+			int64(x.answer.Header.Size)))
+	}
+	conn.Close()
+
+	checkGateway()
+
+	if x.read == nil {
+		return 1, x
+	}
+	return 0, x
+}
+
+// errTimeout is returned when the server does not answer a call or a
+// health check in time.
+var errTimeout = errors.New("gateway timeout")
+
+// recovered returns the value of a panic as an error. The errors are
+// kept as is so they can be matched with errors.Is.
+func recovered(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", r)
+}
+
+// authenticated returns true if response is a capability map
+// accepting the authentication.
+func authenticated(response []byte) bool {
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(response))
+	return err == nil && cm.Authenticated()
+}
+
+// callAuthenticate sends data as the parameter of the authenticate
+// method of the service zero and returns the response.
+func callAuthenticate(data []byte) ([]byte, error) {
 	const serviceID = 0
 	const objectID = 0
 	const actionID = 8
 
-	const timeout = 5 * time.Second
+	timeout := time.Duration(currentTarget().CallTimeout)
 
-	endpoint, err := net.DialEndPoint(serverURL)
+	e, err := pool.get(false)
 	if err != nil {
-		log.Fatalf("failed to contact %s: %s", serverURL, err)
+		panic("gateway has crashed")
 	}
-	channel := bus.NewContext(endpoint)
 
 	ch := make(chan bool, 1)
-	defer close(ch)
 
+	recordMessage(net.Call, data)
+	recordCapabilityMap(data)
+	start := time.Now()
+
+	var response []byte
 	var err0 error
 	go func() {
 		ctx := context.Background()
-		clt := bus.NewClient(channel)
-		_, err0 = clt.Call(ctx.Done(), serviceID, objectID, actionID, data)
+		response, err0 = e.client.Call(ctx.Done(), serviceID, objectID, actionID, data)
 		ch <- true
 	}()
 	timer := time.NewTimer(timeout)
@@ -73,39 +251,43 @@ func Fuzz(data []byte) int {
 	select {
 	case <-ch:
 		timer.Stop()
-		endpoint.Close()
+		if err0 == nil && authenticated(response) {
+			// the connection is no longer in the state
+			// expected by the next inputs.
+			e.Close()
+		} else {
+			pool.put(e, false)
+		}
+		recordLatency(time.Since(start))
+		if err0 != nil {
+			recordError(err0.Error())
+		}
+		return response, err0
 	case <-timer.C:
-		endpoint.Close()
-		panic("gateway timeout1")
+		// the call may still be pending: do not reuse the
+		// connection.
+		e.Close()
+		return nil, errTimeout
 	}
+}
 
-	ch = make(chan bool, 1)
-
-	go func() {
-		// check if everything is still OK.
-		endpoint, err = net.DialEndPoint(serverURL)
-		if err != nil {
-			panic("gateway has crashed")
-		}
-		err = bus.AuthenticateUser(endpoint, "nao", "nao")
-		if err != nil {
-			panic("gateway is broken")
-		}
-		ch <- true
-	}()
+func Fuzz(data []byte) int {
+	ret, _, _ := fuzzAuth(data)
+	return ret
+}
 
-	timer = time.NewTimer(timeout)
-	select {
-	case <-ch:
-		timer.Stop()
-		endpoint.Close()
-	case <-timer.C:
-		endpoint.Close()
-		panic("gateway timeout2")
+// fuzzAuth implements Fuzz and returns the response of the server or
+// the error of the call.
+func fuzzAuth(data []byte) (int, []byte, error) {
+	response, err0 := callAuthenticate(data)
+	if errors.Is(err0, errTimeout) {
+		panic(err0)
 	}
 
+	checkGateway()
+
 	if err0 == nil {
-		return 1
+		return 1, response, nil
 	}
-	return 0
+	return 0, nil, err0
 }
@@ -105,7 +105,7 @@ func WriteSample(filename string, cm bus.CapabilityMap) error {
 		return err
 	}
 	var buf bytes.Buffer
-	err = bus.WriteCapabilityMap(cm, &buf)
+	err = WriteSortedCapabilityMap(cm, &buf)
 	if err != nil {
 		return err
 	}
@@ -116,12 +116,13 @@ func WriteSample(filename string, cm bus.CapabilityMap) error {
 	return nil
 }
 
-func WriteCorpus(dir string) {
+func WriteCorpus(dir string) error {
 	for name, metacap := range GetSamples() {
 		filename := filepath.Join(dir, "cap-auth-"+name+".bin")
 		err := WriteSample(filename, metacap)
 		if err != nil {
-			fmt.Errorf("failed to write %s: %s", name, err)
+			return fmt.Errorf("failed to write %s: %s", name, err)
 		}
 	}
+	return nil
 }
@@ -2,14 +2,119 @@ package fuzz_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lugu/audit/fuzz"
 	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/bus/util"
+	"github.com/lugu/qiloop/meta/signature"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
 )
 
+var serve = flag.String("serve", "", "run the server listening on this address")
+
+// supervisor runs the server of the tests in a child process, unless
+// the target is configured: the failures of the server do not
+// interrupt the tests.
+var supervisor *fuzz.Supervisor
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	config := fuzz.CurrentTarget()
+	if *serve != "" {
+		err := fuzz.ServeDirectory(*serve, config.User, config.Token)
+		log.Fatalf("Server: failed with error %v", err)
+	}
+	if config.URL != "" {
+		os.Exit(m.Run())
+	}
+	dir, err := ioutil.TempDir("", "restarts")
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	url := util.NewUnixAddr()
+	supervisor = fuzz.NewSupervisor([]string{os.Args[0], "-serve", url},
+		url, dir)
+	if err := supervisor.Start(); err != nil {
+		log.Fatalf("%s", err)
+	}
+	code := m.Run()
+	supervisor.Stop()
+	if files, _ := ioutil.ReadDir(dir); len(files) == 0 {
+		os.RemoveAll(dir)
+	} else {
+		fmt.Printf("inputs causing a restart saved in %s\n", dir)
+	}
+	os.Exit(code)
+}
+
+// checkRestarts fails the test if the server was restarted after
+// the restart number since for another reason than a known finding:
+// a near-valid payload can exhaust the memory of the server.
+func checkRestarts(t *testing.T, since int) {
+	if supervisor == nil {
+		return
+	}
+	for _, r := range supervisor.Restarts[since:] {
+		if r.Kind == fuzz.KindMemory {
+			t.Logf("known finding: %s: %s (%s)", r.Kind, r.Reason, r.Input)
+			continue
+		}
+		t.Errorf("server failure: %s: %s (%s)", r.Kind, r.Reason, r.Input)
+	}
+}
+
+// run executes a fuzz entry point with data, through the supervisor
+// of the server if any.
+func run(t *testing.T, entry func([]byte) int, data []byte) {
+	if supervisor == nil {
+		entry(data)
+		return
+	}
+	since := len(supervisor.Restarts)
+	supervisor.Run(entry, data)
+	checkRestarts(t, since)
+}
+
+// envSeed is the environment variable used to replay the random
+// inputs of a failed test.
+const envSeed = "FUZZ_SEED"
+
+// newGenerator returns a randomly seeded generator, unless envSeed
+// is set. The seed is logged if the test fails.
+func newGenerator(t *testing.T) *fuzz.Generator {
+	seed := time.Now().UnixNano()
+	if s := os.Getenv(envSeed); s != "" {
+		var err error
+		seed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid %s: %s", envSeed, err)
+		}
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("reproduce with %s=%d", envSeed, seed)
+		}
+	})
+	return fuzz.NewGenerator(seed)
+}
+
 func TestFuzzOK(t *testing.T) {
 	data, err := ioutil.ReadFile(filepath.Join("testdata",
 		"cap-auth-failure.bin"))
@@ -21,6 +126,96 @@ func TestFuzzOK(t *testing.T) {
 	}
 }
 
+func TestStats(t *testing.T) {
+	fuzz.ResetStats()
+	cm := bus.CapabilityMap{"auth_user": value.String("nao")}
+	var buf bytes.Buffer
+	if err := bus.WriteCapabilityMap(cm, &buf); err != nil {
+		t.Fatal(err)
+	}
+	fuzz.Fuzz(buf.Bytes())
+	stats := fuzz.CurrentStats()
+	if stats.Messages["call"] != 1 {
+		t.Errorf("calls: %d", stats.Messages["call"])
+	}
+	if stats.CapabilityKeys["auth_user"] != 1 {
+		t.Errorf("capability keys: %v", stats.CapabilityKeys)
+	}
+	answers := 0
+	for _, b := range stats.Latency {
+		answers += b.Count
+	}
+	if answers != 1 {
+		t.Errorf("latency: %v", stats.Latency)
+	}
+
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := stats.WriteReport(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "stats.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded fuzz.Stats
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Messages["call"] != 1 || decoded.Duration != stats.Duration {
+		t.Errorf("inconsistent report: %s", data)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata",
+		"cap-auth-failure.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := fuzz.Replay("auth", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(response, bus.KeyState) {
+		t.Errorf("missing authentication state: %s", response)
+	}
+	response, err = fuzz.Replay("serializer", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(response, `"auth_user": tablet`) {
+		t.Errorf("missing user: %s", response)
+	}
+	if _, err := fuzz.Replay("unknown", data); err == nil {
+		t.Errorf("unknown target accepted")
+	}
+	if err := fuzz.PingGateway(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata",
+		"cap-auth-failure.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fuzz.ResetStats()
+	for i := 0; i < 10; i++ {
+		if fuzz.Fuzz(data) != 1 {
+			t.Fatalf("shall return 1")
+		}
+	}
+	// one for the calls and one for the health check at most.
+	if stats := fuzz.CurrentStats(); stats.Connections > 2 {
+		t.Errorf("connections not reused: %d", stats.Connections)
+	}
+}
+
 func WriteReadTest(cm bus.CapabilityMap) error {
 	var buf bytes.Buffer
 	err := bus.WriteCapabilityMap(cm, &buf)
@@ -44,8 +239,9 @@ func TestSamples(t *testing.T) {
 }
 
 func TestCaps(t *testing.T) {
+	g := newGenerator(t)
 	for i := 0; i < 20; i++ {
-		perm := fuzz.MakeCap()
+		perm := g.MakeCap()
 		var buf bytes.Buffer
 		err := bus.WriteCapabilityMap(perm, &buf)
 		if err != nil {
@@ -56,3 +252,599 @@ func TestCaps(t *testing.T) {
 		}
 	}
 }
+
+func TestPayloads(t *testing.T) {
+	signatures := []string{
+		"s",
+		"[m]",
+		"{sm}",
+		"(sI)<ServiceInfo,name,id>",
+		"(sIsI[s]s)<ServiceInfo,name,serviceId,machineId,processId,endpoints,sessionId>",
+		"({I(Issss[(ss)<MetaMethodParameter,name,description>]s)<MetaMethod,uid,returnSignature,name,parametersSignature,description,parameters,returnDescription>}s)<MetaObject,methods,description>",
+		"(bcCwWiIlLfdo)",
+	}
+	g := newGenerator(t)
+	for _, sig := range signatures {
+		reader, err := signature.MakeReader(sig)
+		if err != nil {
+			t.Fatalf("invalid signature %s: %s", sig, err)
+		}
+		for i := 0; i < 10; i++ {
+			data, err := g.MakePayload(sig, true)
+			if err != nil {
+				t.Fatalf("failed to generate %s: %s", sig, err)
+			}
+			buf := bytes.NewBuffer(data)
+			if _, err = reader.Read(buf); err != nil {
+				t.Errorf("failed to read %s: %s", sig, err)
+			} else if buf.Len() != 0 {
+				t.Errorf("%s: %d bytes not read", sig, buf.Len())
+			}
+			if _, err = g.MakePayload(sig, false); err != nil {
+				t.Fatalf("failed to generate %s: %s", sig, err)
+			}
+		}
+	}
+	if _, err := g.MakePayload("(s", true); err == nil {
+		t.Errorf("shall fail to parse an invalid signature")
+	}
+}
+
+func TestFuzzService(t *testing.T) {
+	fuzzService := fuzz.FuzzService
+	if supervisor != nil {
+		// the server is restarted after a crash.
+		defer checkRestarts(t, len(supervisor.Restarts))
+		fuzzService = supervisor.FuzzService
+	}
+	stats, err := fuzzService(newGenerator(t), fuzz.DirectoryServiceID,
+		fuzz.DirectoryObjectID, 2)
+	if err != nil {
+		t.Fatalf("server failure: %s", err)
+	}
+	if len(stats) == 0 {
+		t.Fatalf("no action found")
+	}
+	for _, s := range stats {
+		if s.Calls != 2 {
+			t.Errorf("%s: unexpected number of calls", s)
+		}
+	}
+}
+
+func TestRunGenerated(t *testing.T) {
+	if supervisor == nil {
+		t.Skip("the server is not supervised")
+	}
+	generate := func() [][]byte {
+		var mutex sync.Mutex
+		inputs := make([][]byte, 0)
+		record := func(data []byte) int {
+			mutex.Lock()
+			defer mutex.Unlock()
+			inputs = append(inputs, data)
+			return 0
+		}
+		makeCap := func(g *fuzz.Generator) []byte {
+			return g.MutateCredentials(fuzz.GetSamples()["basic"])
+		}
+		for _, err := range supervisor.RunGenerated(record, makeCap, 6, 3, 42) {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		sort.Slice(inputs, func(i, j int) bool {
+			return bytes.Compare(inputs[i], inputs[j]) < 0
+		})
+		return inputs
+	}
+	a, b := generate(), generate()
+	if len(a) != 6 || !reflect.DeepEqual(a, b) {
+		t.Errorf("inputs not reproducible")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("no worker accepted")
+		}
+	}()
+	supervisor.RunGenerated(fuzz.Fuzz, nil, 6, 0, 42)
+}
+
+func TestSupervisor(t *testing.T) {
+	if supervisor == nil {
+		t.Skip("the server is not supervised")
+	}
+	since := len(supervisor.Restarts)
+	crash := func(data []byte) int {
+		panic("gateway has crashed")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := supervisor.Run(crash, []byte{byte(i)}); err == nil {
+			t.Fatalf("failure not reported")
+		}
+	}
+	restarts := supervisor.Restarts[since:]
+	if len(restarts) != 2 || restarts[0].Input == restarts[1].Input {
+		t.Fatalf("unexpected restarts: %v", restarts)
+	}
+	for i, r := range restarts {
+		if r.Kind != fuzz.KindConnectionRefused {
+			t.Errorf("unexpected kind: %s", r.Kind)
+		}
+		data, err := ioutil.ReadFile(r.Input)
+		if err != nil || !bytes.Equal(data, []byte{byte(i)}) {
+			t.Errorf("input not saved: %v, %v", data, err)
+		}
+		os.Remove(r.Input)
+	}
+	if err := fuzz.PingGateway(); err != nil {
+		t.Errorf("server not restarted: %s", err)
+	}
+}
+
+func TestMakeSession(t *testing.T) {
+	g := newGenerator(t)
+	// without signal, then without method nor signal.
+	metas := []object.MetaObject{object.MetaService0, {}}
+	for _, meta := range metas {
+		for i := 0; i < 3; i++ {
+			session := g.MakeSession(meta, 0, 0, 10)
+			if len(session) != 10 {
+				t.Fatalf("%d messages instead of 10", len(session))
+			}
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	output := func(message, args string) []byte {
+		return []byte("some logs\npanic: " + message + "\n\n" +
+			"goroutine 7 [running]:\n" +
+			"github.com/lugu/qiloop/bus.(*client).Call(" + args + ")\n" +
+			"\t/go/src/bus/client.go:42 +0x1d\n" +
+			"created by github.com/lugu/audit/fuzz.Fuzz\n")
+	}
+	a := fuzz.Classify(output("runtime error: index out of range", "0x1"), true, 2)
+	b := fuzz.Classify(output("runtime error: index out of range", "0x2"), true, 2)
+	c := fuzz.Classify(output("runtime error: nil pointer", "0x1"), true, 2)
+	if a.Kind != fuzz.KindPanic || a.Key() != b.Key() || a.Key() == c.Key() {
+		t.Errorf("unexpected panic classification: %s, %s, %s", a, b, c)
+	}
+	if f := fuzz.Classify(output("gateway is broken", ""), true, 2); f.Kind != fuzz.KindAuthBroken {
+		t.Errorf("unexpected classification: %s", f)
+	}
+	if f := fuzz.Classify(output("gateway has crashed", ""), true, 2); f.Kind != fuzz.KindConnectionRefused {
+		t.Errorf("unexpected classification: %s", f)
+	}
+	if f := fuzz.Classify(output("gateway timeout", ""), true, 2); f.Kind != fuzz.KindHang {
+		t.Errorf("unexpected classification: %s", f)
+	}
+	d := fuzz.Classify(output("resource leak: goroutines +12 (limit 10)", ""), true, 2)
+	e := fuzz.Classify(output("resource leak: goroutines +15 (limit 10)", ""), true, 2)
+	if d.Kind != fuzz.KindLeak || d.Key() != e.Key() {
+		t.Errorf("unexpected leak classification: %s, %s", d, e)
+	}
+	contact := fuzz.Classify(output("failed to contact unix:///tmp/sock1: refused", ""), true, 2)
+	if contact.Kind != fuzz.KindConnectionRefused {
+		t.Errorf("unexpected classification: %s", contact)
+	}
+	fatal := func(message string) fuzz.Finding {
+		return fuzz.Classify([]byte("2026/10/18 14:05:33 "+message+"\n"), true, 1)
+	}
+	g, h, i := fatal("read 12 bytes: EOF"), fatal("read 42 bytes: EOF"), fatal("invalid token")
+	if g.Kind != fuzz.KindUnknown || g.Key() != h.Key() || g.Key() == i.Key() {
+		t.Errorf("unexpected classification: %s, %s, %s", g, h, i)
+	}
+	if f := fatal("failed to contact tcp://localhost:9559"); f.Kind != fuzz.KindConnectionRefused {
+		t.Errorf("unexpected classification: %s", f)
+	}
+	oom := []byte("fatal error: runtime: out of memory\n\nruntime stack:\n" +
+		"runtime.throw(...)\n\ngoroutine 9 gp=0x1 m=0 [running]:\n" +
+		"runtime.makeslice(0x1)\n" +
+		"github.com/lugu/qiloop/type/object.ReadMetaObject(0x2)\n")
+	if f := fuzz.Classify(oom, true, 2); f.Kind != fuzz.KindMemory {
+		t.Errorf("unexpected classification: %s", f)
+	}
+	j := fuzz.Classify(output("memory exhaustion: oversized collection: 12 elements in 4 bytes", ""), true, 2)
+	k := fuzz.Classify(output("memory exhaustion: oversized collection: 42 elements in 8 bytes", ""), true, 2)
+	if j.Kind != fuzz.KindMemory || j.Key() != k.Key() {
+		t.Errorf("unexpected oversized classification: %s, %s", j, k)
+	}
+	if f := fuzz.Classify(nil, false, 0); f.Kind != fuzz.KindHang {
+		t.Errorf("unexpected classification: %s", f)
+	}
+	if f := fuzz.Classify(nil, true, 0); f.Kind != fuzz.KindNone {
+		t.Errorf("unexpected classification: %s", f)
+	}
+}
+
+func TestLoadTarget(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "target.json")
+	err := ioutil.WriteFile(config, []byte(`{
+		"url": "tcps://robot:9503",
+		"user": "nao",
+		"call_timeout": "1s",
+		"tls": { "server_name": "robot" }
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(fuzz.EnvConfig, config)
+	t.Setenv(fuzz.EnvToken, "secret")
+	target, err := fuzz.LoadTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.URL != "tcps://robot:9503" || target.User != "nao" ||
+		target.Token != "secret" || target.TLS.ServerName != "robot" {
+		t.Errorf("unexpected target: %#v", target)
+	}
+	if time.Duration(target.CallTimeout) != time.Second ||
+		target.HealthTimeout != fuzz.DefaultTarget().HealthTimeout {
+		t.Errorf("unexpected timeouts: %#v", target)
+	}
+}
+
+func TestMinimizeCapabilityMap(t *testing.T) {
+	var buf bytes.Buffer
+	err := bus.WriteCapabilityMap(fuzz.GetSamples()["extra"], &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minimal := fuzz.MinimizeCapabilityMap(buf.Bytes())
+	if fuzz.Behaviour(minimal) != fuzz.Behaviour(buf.Bytes()) {
+		t.Errorf("behaviour changed")
+	}
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(minimal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a value of each type is kept along with the user and the token.
+	signatures := make(map[string]bool)
+	for _, v := range fuzz.GetSamples()["extra"] {
+		signatures[v.Signature()] = true
+	}
+	if len(cm) != len(signatures)+2 {
+		t.Errorf("unexpected minimal map: %v", cm)
+	}
+}
+
+func TestMergeCorpora(t *testing.T) {
+	a, b, out := t.TempDir(), t.TempDir(), t.TempDir()
+	for _, dir := range []string{a, b} {
+		if err := fuzz.WriteCorpus(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept, dropped, err := fuzz.MergeCorpora([]string{a, b}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the samples authenticate successfully with values of
+	// different types: the copies of the second corpus are dropped.
+	if kept != 4 || dropped != 4 {
+		t.Errorf("unexpected merge: %d kept, %d dropped", kept, dropped)
+	}
+}
+
+func TestSeedCorpus(t *testing.T) {
+	var capture, caps, meta bytes.Buffer
+	err := bus.WriteCapabilityMap(fuzz.GetSamples()["basic"], &caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = object.WriteMetaObject(object.MetaService0, &meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []net.Message{
+		net.NewMessage(net.NewHeader(net.Call, 0, 0, 8, 1), caps.Bytes()),
+		net.NewMessage(net.NewHeader(net.Reply, 1, 1,
+			object.MetaObjectMethodID, 2), meta.Bytes()),
+		net.NewMessage(net.NewHeader(net.Call, 1, 1, 101, 3), nil),
+	}
+	for _, m := range messages {
+		if err := m.Write(&capture); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// truncated message
+	capture.Write([]byte{0x42, 0xde, 0xad})
+
+	read, err := fuzz.ReadSession(&capture)
+	if err == nil || len(read) != len(messages) {
+		t.Fatalf("unexpected capture: %d messages, %v", len(read), err)
+	}
+	corpus := fuzz.SeedCorpus(read)
+	expected := map[string]int{
+		fuzz.CorpusCapability: 1,
+		fuzz.CorpusMessage:    3,
+		fuzz.CorpusMetaObject: 1,
+		fuzz.CorpusSession:    1,
+		fuzz.CorpusPayload:    2,
+	}
+	for name, count := range expected {
+		if len(corpus[name]) != count {
+			t.Errorf("%s: %d inputs instead of %d", name,
+				len(corpus[name]), count)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, metacap := range fuzz.GetSamples() {
+		var buf bytes.Buffer
+		if err := bus.WriteCapabilityMap(metacap, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fuzz.RoundTrip(buf.Bytes()); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestRoundTripAsymmetry(t *testing.T) {
+	// A structure embedding a value: once decoded, the signature
+	// of the embedded value loses its size prefix.
+	embedded := value.String("embedded")
+	var data bytes.Buffer
+	if err := embedded.Write(&data); err != nil {
+		t.Fatal(err)
+	}
+	cm := bus.CapabilityMap{
+		"struct": value.Opaque("(m)<Struct,value>", data.Bytes()),
+	}
+	var buf bytes.Buffer
+	if err := bus.WriteCapabilityMap(cm, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fuzz.RoundTrip(buf.Bytes()); err != nil {
+		t.Skipf("known finding: %s", err)
+	}
+}
+
+func TestCompareCapabilityMaps(t *testing.T) {
+	embedded := func(s string) value.Value {
+		var data bytes.Buffer
+		value.String(s).Write(&data)
+		basic.WriteString("other", &data)
+		return value.Opaque("(ms)<Struct,value,name>", data.Bytes())
+	}
+	a := bus.CapabilityMap{"struct": embedded("a")}
+	if err := fuzz.CompareCapabilityMaps(a, a); err != nil {
+		t.Errorf("unexpected difference: %s", err)
+	}
+	b := bus.CapabilityMap{"struct": embedded("b")}
+	err := fuzz.CompareCapabilityMaps(a, b)
+	if err == nil || !strings.Contains(err.Error(), ".value.value") {
+		t.Errorf("unexpected difference: %v", err)
+	}
+}
+
+func TestMetaObject(t *testing.T) {
+	var buf bytes.Buffer
+	if err := object.WriteMetaObject(object.MetaService0, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if fuzz.FuzzMetaObject(buf.Bytes()) != 1 {
+		t.Errorf("failed to decode MetaObject")
+	}
+	if fuzz.FuzzMetaObjectReply(buf.Bytes()) != 1 {
+		t.Errorf("failed to receive MetaObject")
+	}
+	// 0x08000000 methods announced in a few bytes.
+	oversized := []byte{0, 0, 0, 8, 1, 0, 0, 0}
+	saved := fuzz.CurrentTarget()
+	defer fuzz.SetTarget(saved)
+	config := saved
+	config.SkipOversized = true
+	fuzz.SetTarget(config)
+	if fuzz.FuzzMetaObject(oversized) != -1 {
+		t.Errorf("oversized MetaObject not skipped")
+	}
+	fuzz.SetTarget(saved)
+	defer func() {
+		r := recover()
+		if msg, _ := r.(string); !strings.HasPrefix(msg, fuzz.KindMemory) {
+			t.Errorf("oversized MetaObject not reported: %v", r)
+		}
+	}()
+	fuzz.FuzzMetaObject(oversized)
+}
+
+func TestRunClient(t *testing.T) {
+	script, err := fuzz.RecordScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := fuzz.RunClient(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("client failed against the recorded script")
+	}
+	// the server disconnects the client in the middle of the session.
+	if _, err := fuzz.RunClient(script[:len(script)/2]); err != nil {
+		t.Errorf("truncated script: %s", err)
+	}
+}
+
+func TestMutateCredentials(t *testing.T) {
+	g := newGenerator(t)
+	sample := fuzz.GetSamples()["basic"]
+	var buf bytes.Buffer
+	if err := bus.WriteCapabilityMap(sample, &buf); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := fuzz.Replay("auth", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(accepted, "reply: ") {
+		t.Fatalf("authentic credentials: %s", accepted)
+	}
+	for i := 0; i < 50; i++ {
+		data := g.MutateCredentials(sample)
+		response, err := fuzz.Replay("auth", data)
+		if err != nil {
+			t.Fatalf("mutation %d: %s", i, err)
+		}
+		// some mutations keep the user and the token: only the
+		// altered credentials must be rejected.
+		cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(data))
+		if err == nil && equalValues(cm[bus.KeyUser], sample[bus.KeyUser]) &&
+			equalValues(cm[bus.KeyToken], sample[bus.KeyToken]) {
+			continue
+		}
+		if response == accepted {
+			t.Errorf("mutation %d authenticates: %x", i, data)
+		}
+	}
+	if err := fuzz.PingGateway(); err != nil {
+		t.Fatalf("gateway does not answer: %s", err)
+	}
+	a := fuzz.NewGenerator(1).MutateCredentials(sample)
+	b := fuzz.NewGenerator(1).MutateCredentials(sample)
+	if !bytes.Equal(a, b) {
+		t.Errorf("mutation not reproducible")
+	}
+}
+
+// equalValues returns true if a and b are set and serialized the same
+// way.
+func equalValues(a, b value.Value) bool {
+	return a != nil && b != nil && bytes.Equal(value.Bytes(a), value.Bytes(b))
+}
+
+func TestWatchdog(t *testing.T) {
+	if _, err := fuzz.ReadUsage(0); err != nil {
+		t.Skipf("usage not supported: %s", err)
+	}
+	saved := fuzz.CurrentTarget()
+	defer fuzz.SetTarget(saved)
+	config := saved
+	config.HealthTimeout = fuzz.Duration(200 * time.Millisecond)
+	config.Limits.Goroutines = 10
+	fuzz.SetTarget(config)
+
+	entry, err := fuzz.Watch(fuzz.Fuzz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	bus.WriteCapabilityMap(fuzz.GetSamples()["basic"], &buf)
+	entry(buf.Bytes())
+
+	done := make(chan struct{})
+	defer close(done)
+	leak := func(data []byte) int {
+		for i := 0; i < 20; i++ {
+			go func() { <-done }()
+		}
+		return 0
+	}
+	if entry, err = fuzz.Watch(leak); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		r := recover()
+		if msg, _ := r.(string); !strings.HasPrefix(msg, fuzz.KindLeak) {
+			t.Errorf("leak not detected: %v", r)
+		}
+	}()
+	entry(nil)
+}
+
+func TestMakeSignature(t *testing.T) {
+	g := newGenerator(t)
+	for i := 0; i < 100; i++ {
+		sig := g.MakeSignature(3)
+		if _, err := signature.Parse(sig); err != nil {
+			t.Errorf("invalid signature %s: %s", sig, err)
+			continue
+		}
+		if _, err := fuzz.CheckSignature(sig); err != nil {
+			t.Errorf("inconsistent signature %s: %s", sig, err)
+		}
+		if _, err := g.MakePayload(sig, true); err != nil {
+			t.Errorf("invalid payload %s: %s", sig, err)
+		}
+	}
+	sig := "({sm}[(ss)<Pair,first,second>]o)<Info,map,list,object>"
+	if _, err := fuzz.CheckSignature(sig); err != nil {
+		t.Errorf("%s: %s", sig, err)
+	}
+}
+
+func TestMakeExtendedSignature(t *testing.T) {
+	g := newGenerator(t)
+	for i := 0; i < 100; i++ {
+		sig := g.MakeExtendedSignature(3)
+		if !strings.ContainsAny(sig, "+#") {
+			continue
+		}
+		if _, err := signature.Parse(sig); err == nil {
+			t.Errorf("shall reject %s", sig)
+		}
+		if fuzz.FuzzSignature([]byte(sig)) != 0 {
+			t.Errorf("shall ignore %s", sig)
+		}
+	}
+}
+
+func TestMakePayloadObject(t *testing.T) {
+	g := newGenerator(t)
+	for i := 0; i < 10; i++ {
+		data, err := g.MakePayload("o", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(data)
+		if _, err := object.ReadObjectReference(buf); err != nil {
+			t.Fatalf("invalid object reference: %s", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%d bytes not read", buf.Len())
+		}
+	}
+}
+
+func TestSignatureMapKey(t *testing.T) {
+	// the type constructor uses reflect.MapOf which panics if the
+	// key of the map is not comparable.
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if msg := fmt.Sprint(r); strings.Contains(msg, "reflect.MapOf") {
+			t.Skipf("known finding: %s", msg)
+		}
+		t.Errorf("unexpected panic: %v", r)
+	}()
+	fuzz.FuzzSignature([]byte("{[l]s}"))
+}
+
+func TestGeneratorSeed(t *testing.T) {
+	write := func(g *fuzz.Generator) []byte {
+		var buf bytes.Buffer
+		for i := 0; i < 5; i++ {
+			err := fuzz.WriteSortedCapabilityMap(g.MakeCap(), &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString(g.MakeSignature(3))
+		}
+		return buf.Bytes()
+	}
+	a := write(fuzz.NewGenerator(42))
+	b := write(fuzz.NewGenerator(42))
+	c := write(fuzz.NewGenerator(43))
+	if !bytes.Equal(a, b) {
+		t.Errorf("same seed, different inputs")
+	}
+	if bytes.Equal(a, c) {
+		t.Errorf("different seeds, same inputs")
+	}
+}
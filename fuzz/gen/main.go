@@ -2,26 +2,60 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/lugu/audit/fuzz"
-	"github.com/lugu/qiloop/bus"
 )
 
 func main() {
 	dir := "corpus"
 	flag.StringVar(&dir, "d", dir, "output directory")
+	var seed = flag.Int64("seed", 0, "random seed (0 for a random one)")
 	flag.Parse()
 
-	fuzz.WriteCorpus(dir)
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("seed: %d", *seed)
+	generator := fuzz.NewGenerator(*seed)
+
+	err := fuzz.WriteCorpus(dir)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
 
 	for i := 0; i < 20; i++ {
-		perm := fuzz.MakeCap()
-		file, _ := ioutil.TempFile(dir, "cap-*.bin")
-		err := bus.WriteCapabilityMap(perm, file)
+		perm := generator.MakeCap()
+		name := fmt.Sprintf("cap-%d-%02d.bin", *seed, i)
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		err = fuzz.WriteSortedCapabilityMap(perm, file)
 		if err != nil {
 			panic(err)
 		}
 		file.Close()
 	}
+
+	samples := fuzz.GetSamples()
+	names := make([]string, 0, len(samples))
+	for name := range samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := 0; i < 20; i++ {
+		data := generator.MutateCredentials(samples[names[i%len(names)]])
+		name := fmt.Sprintf("cred-%d-%02d.bin", *seed, i)
+		err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
 }
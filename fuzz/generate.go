@@ -6,6 +6,8 @@ import (
 	"bytes"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	gofuzz "github.com/google/gofuzz"
 	"github.com/lugu/qiloop/bus"
@@ -13,8 +15,34 @@ import (
 	"github.com/lugu/qiloop/type/value"
 )
 
+// Generator produces random capability maps, credentials, payloads,
+// signatures and sessions. Two generators created with the same seed produce
+// the same sequence of inputs. A Generator is not safe for concurrent
+// use: each goroutine needs its own Generator.
+type Generator struct {
+	seed   int64
+	fuzzer *gofuzz.Fuzzer
+}
+
+// NewGenerator returns a Generator using seed as the source of
+// randomness.
+func NewGenerator(seed int64) *Generator {
+	return &Generator{
+		seed:   seed,
+		fuzzer: gofuzz.NewWithSeed(seed).NilChance(0).Funcs(makeValue, makePayload, makeSession, makeSignature, makeCredential).NumElements(1, 100),
+	}
+}
+
+// Seed returns the seed of the generator.
+func (g *Generator) Seed() int64 {
+	return g.seed
+}
+
+// generator is the randomly seeded Generator used by the functions
+// of the package. generatorMutex serializes its use.
 var (
-	fuzzer = gofuzz.New().NilChance(0).Funcs(makeValue).NumElements(1, 100)
+	generatorMutex sync.Mutex
+	generator      = NewGenerator(time.Now().UnixNano())
 )
 
 func cleanName(c gofuzz.Continue) string {
@@ -40,7 +68,7 @@ func makeObject(i *value.Value, c gofuzz.Continue) {
 	var ref object.ObjectReference
 	c.Fuzz(&ref)
 	var buf bytes.Buffer
-	object.WriteObjectReference(ref, &buf)
+	writeSortedObjectReference(ref, &buf)
 	*i = value.Opaque("o", buf.Bytes())
 }
 
@@ -127,14 +155,23 @@ func makeValue(i *value.Value, c gofuzz.Continue) {
 	}
 }
 
-func MakeCap() bus.CapabilityMap {
+// MakeCap returns a random capability map with a user and a token.
+func (g *Generator) MakeCap() bus.CapabilityMap {
 	var permission bus.CapabilityMap
-	fuzzer.Fuzz(&permission)
+	g.fuzzer.Fuzz(&permission)
 	var user string
-	fuzzer.Fuzz(&user)
+	g.fuzzer.Fuzz(&user)
 	permission["user"] = value.String(user)
 	var token string
-	fuzzer.Fuzz(&token)
+	g.fuzzer.Fuzz(&token)
 	permission["token"] = value.String(token)
 	return permission
 }
+
+// MakeCap returns a random capability map using the default
+// generator.
+func MakeCap() bus.CapabilityMap {
+	generatorMutex.Lock()
+	defer generatorMutex.Unlock()
+	return generator.MakeCap()
+}
@@ -0,0 +1,169 @@
+package fuzz
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	gofuzz "github.com/google/gofuzz"
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/qiloop/meta/signature"
+)
+
+// signatureRequest is the input of makeSignature.
+type signatureRequest struct {
+	depth    int  // maximum nesting of the composite types
+	extended bool // generate optionals and varargs
+	typ      *capture.Type
+}
+
+// signatureKinds are the basic types of the generated signatures:
+// the raw data, void and unknown types of capture.BasicKinds are not
+// part of the grammar accepted by qiloop.
+const signatureKinds = "bcCwWiIlLfdsmo"
+
+// keyKinds are the basic types accepted as the key of a map: the type
+// constructor cannot build a map indexed by an object.
+const keyKinds = "bcCwWiIlLfdsm"
+
+// makeSignature generates a random type following the grammar of
+// the signatures: basic types, lists, maps, tuples and structs (with
+// their annotation). The keys of the maps are basic types, tuples or
+// structs of such keys. Extended signatures contain optionals and
+// varargs as well.
+func makeSignature(r *signatureRequest, c gofuzz.Continue) {
+	r.typ = makeSigType(r.depth, false, r.extended, c)
+}
+
+// makeSigType returns a type with at most depth levels of nested
+// types. If key is true, the type can be used as the key of a map. If
+// extended is true, the type can contain optionals and varargs.
+func makeSigType(depth int, key, extended bool, c gofuzz.Continue) *capture.Type {
+	kinds := signatureKinds
+	if key {
+		kinds = keyKinds
+	}
+	choice := 0
+	if depth > 0 && extended {
+		choice = c.Intn(7)
+	} else if depth > 0 {
+		choice = c.Intn(6)
+	}
+	if key && (choice == 1 || choice == 2 || choice == 6) {
+		// lists, maps, optionals and varargs are not valid keys.
+		choice = 0
+	}
+	switch choice {
+	case 1:
+		return &capture.Type{Kind: '[', Members: []*capture.Type{
+			makeSigType(depth-1, false, extended, c),
+		}}
+	case 2:
+		return &capture.Type{Kind: '{', Members: []*capture.Type{
+			makeSigType(depth-1, true, extended, c),
+			makeSigType(depth-1, false, extended, c),
+		}}
+	case 6:
+		kind := byte('+')
+		if c.RandBool() {
+			kind = '#'
+		}
+		return &capture.Type{Kind: kind, Members: []*capture.Type{
+			makeSigType(depth-1, false, extended, c),
+		}}
+	case 3, 4:
+		t := &capture.Type{Kind: '('}
+		size := c.Intn(5)
+		for i := 0; i < size; i++ {
+			t.Members = append(t.Members,
+				makeSigType(depth-1, key, extended, c))
+		}
+		if choice == 4 {
+			t.Name = cleanName(c)
+			if c.Intn(4) == 0 {
+				// C++ style name (ex: List<double>)
+				t.Name += "<" + cleanName(c) + ">"
+			}
+			// the fields of a struct have distinct names once
+			// converted to Go.
+			seen := make(map[string]bool)
+			for len(t.Fields) < size {
+				field := cleanName(c)
+				if !seen[signature.CleanName(field)] {
+					seen[signature.CleanName(field)] = true
+					t.Fields = append(t.Fields, field)
+				}
+			}
+		}
+		return t
+	default:
+		return &capture.Type{Kind: kinds[c.Intn(len(kinds))]}
+	}
+}
+
+// MakeSignature returns a random type signature with at most depth
+// levels of nested types.
+func (g *Generator) MakeSignature(depth int) string {
+	r := signatureRequest{depth: depth}
+	g.fuzzer.Fuzz(&r)
+	return r.typ.String()
+}
+
+// MakeExtendedSignature returns a random type signature with at most
+// depth levels of nested types, including optionals and varargs.
+// qiloop does not support them: the parser shall reject such
+// signatures.
+func (g *Generator) MakeExtendedSignature(depth int) string {
+	r := signatureRequest{depth: depth, extended: true}
+	g.fuzzer.Fuzz(&r)
+	return r.typ.String()
+}
+
+// MakeSignature returns a random type signature using the default
+// generator.
+func MakeSignature(depth int) string {
+	generatorMutex.Lock()
+	defer generatorMutex.Unlock()
+	return generator.MakeSignature(depth)
+}
+
+// CheckSignature parses sig, constructs its type and generates the
+// associated Go code. It returns an error if the signature of the
+// constructed type is not parsed into the same type.
+func CheckSignature(sig string) (signature.Type, error) {
+	t, err := signature.Parse(sig)
+	if err != nil {
+		return nil, err
+	}
+	t.Reader()
+	t.Type()
+	t.SignatureIDL()
+	sig2 := t.Signature()
+	t2, err := signature.Parse(sig2)
+	if err != nil {
+		return t, fmt.Errorf("inconsistent signature: %s became %s: %s",
+			sig, sig2, err)
+	}
+	if sig3 := t2.Signature(); sig3 != sig2 {
+		return t, fmt.Errorf("inconsistent signature: %s became %s then %s",
+			sig, sig2, sig3)
+	}
+	// GenerateType renames the structs in case of collision.
+	if err := signature.GenerateType(t, "fuzz", ioutil.Discard); err != nil {
+		return t, fmt.Errorf("inconsistent type %s: %s", sig2, err)
+	}
+	return t, nil
+}
+
+// FuzzSignature runs the signature parser and the type constructor
+// on data. It panics if the type is not consistent with its
+// signature.
+func FuzzSignature(data []byte) int {
+	t, err := CheckSignature(string(data))
+	if t == nil {
+		return 0
+	}
+	if err != nil {
+		panic(err.Error())
+	}
+	return 1
+}
@@ -0,0 +1,255 @@
+package fuzz_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/lugu/audit/fuzz"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// addSamples populates the seed corpus of f with the capability map
+// samples.
+func addSamples(f *testing.F) {
+	for _, metacap := range fuzz.GetSamples() {
+		var buf bytes.Buffer
+		err := bus.WriteCapabilityMap(metacap, &buf)
+		if err != nil {
+			f.Fatalf("failed to write sample: %s", err)
+		}
+		f.Add(buf.Bytes())
+	}
+}
+
+// addSeeds populates the seed corpus of f with the capability map
+// samples, a few random capability maps and the binary files of
+// testdata.
+func addSeeds(f *testing.F) {
+	addSamples(f)
+	// fixed seed: the seed corpus is the same on every run.
+	g := fuzz.NewGenerator(1)
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+		err := fuzz.WriteSortedCapabilityMap(g.MakeCap(), &buf)
+		if err != nil {
+			f.Fatalf("failed to write capability map: %s", err)
+		}
+		f.Add(buf.Bytes())
+		f.Add(g.MutateCredentials(fuzz.GetSamples()["basic"]))
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "*.bin"))
+	if err != nil {
+		f.Fatalf("cannot list test data: %s", err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatalf("cannot open test data %s", err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzCapabilityMap(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.FuzzSerializer(data)
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	// random capability maps often contain embedded values in
+	// structures which are not encoded symmetrically (see
+	// TestRoundTripAsymmetry).
+	addSamples(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.FuzzRoundTrip(data)
+	})
+}
+
+func FuzzAuthenticateCall(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		run(t, fuzz.Fuzz, data)
+	})
+}
+
+func FuzzMessage(f *testing.F) {
+	var payload bytes.Buffer
+	err := bus.WriteCapabilityMap(fuzz.GetSamples()["basic"], &payload)
+	if err != nil {
+		f.Fatalf("failed to write sample: %s", err)
+	}
+	for typ := net.Call; typ <= net.Cancelled; typ++ {
+		for _, service := range []uint32{0, 1} {
+			hdr := net.NewHeader(typ, service, service, 8, 1)
+			msg := net.NewMessage(hdr, payload.Bytes())
+			var buf bytes.Buffer
+			if err := msg.Write(&buf); err != nil {
+				f.Fatalf("failed to write message: %s", err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		run(t, fuzz.FuzzMessage, data)
+	})
+}
+
+func FuzzSession(f *testing.F) {
+	meta, err := fuzz.FetchMetaObject(fuzz.DirectoryServiceID,
+		fuzz.DirectoryObjectID)
+	if err != nil {
+		f.Fatalf("failed to fetch meta object: %s", err)
+	}
+	// fixed seed: the seed corpus is the same on every run.
+	g := fuzz.NewGenerator(1)
+	for i := 0; i < 5; i++ {
+		session := g.MakeSession(meta, fuzz.DirectoryServiceID,
+			fuzz.DirectoryObjectID, 20)
+		var buf bytes.Buffer
+		if err := session.Write(&buf); err != nil {
+			f.Fatalf("failed to write session: %s", err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		run(t, fuzz.FuzzSession, data)
+	})
+}
+
+func FuzzObjectReference(f *testing.F) {
+	refs := []object.ObjectReference{
+		{},
+		{
+			MetaObject: object.MetaService0,
+			ServiceID:  2,
+			ObjectID:   3,
+		},
+	}
+	for _, ref := range refs {
+		var buf bytes.Buffer
+		if err := object.WriteObjectReference(ref, &buf); err != nil {
+			f.Fatalf("failed to write object reference: %s", err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.FuzzObjectReference(data)
+	})
+}
+
+// addMetaObjects populates the seed corpus of f with well known
+// MetaObjects.
+func addMetaObjects(f *testing.F) {
+	metas := []object.MetaObject{
+		object.MetaService0,
+		object.ObjectMetaObject,
+		object.FullMetaObject(object.MetaService0),
+	}
+	for _, meta := range metas {
+		var buf bytes.Buffer
+		if err := object.WriteMetaObject(meta, &buf); err != nil {
+			f.Fatalf("failed to write MetaObject: %s", err)
+		}
+		f.Add(buf.Bytes())
+	}
+}
+
+func FuzzMetaObject(f *testing.F) {
+	addMetaObjects(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.FuzzMetaObject(data)
+	})
+}
+
+func FuzzMetaObjectReply(f *testing.F) {
+	addMetaObjects(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.FuzzMetaObjectReply(data)
+	})
+}
+
+func FuzzSignature(f *testing.F) {
+	signatures := []string{
+		"s",
+		"[m]",
+		"{sm}",
+		"(bcCwWiIlLfdo)",
+		"(sIsI[s]s)<ServiceInfo,name,serviceId,machineId,processId,endpoints,sessionId>",
+		"({I(Issss[(ss)<MetaMethodParameter,name,description>]s)<MetaMethod,uid,returnSignature,name,parametersSignature,description,parameters,returnDescription>}s)<MetaObject,methods,description>",
+		"(L[d])<Matrix<double>,size,data>",
+		// optionals and varargs are rejected by the parser.
+		"+s",
+		"#[i]",
+	}
+	for _, sig := range signatures {
+		f.Add([]byte(sig))
+	}
+	// fixed seed: the seed corpus is the same on every run.
+	g := fuzz.NewGenerator(1)
+	for i := 0; i < 10; i++ {
+		f.Add([]byte(g.MakeSignature(3)))
+		f.Add([]byte(g.MakeExtendedSignature(3)))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.FuzzSignature(data)
+	})
+}
+
+// servicesActionID is the action of the services method of the
+// ServiceDirectory.
+const servicesActionID = 101
+
+func FuzzClient(f *testing.F) {
+	script, err := fuzz.RecordScript()
+	if err != nil {
+		f.Fatalf("failed to record script: %s", err)
+	}
+	meta, err := fuzz.FetchMetaObject(fuzz.DirectoryServiceID,
+		fuzz.DirectoryObjectID)
+	if err != nil {
+		f.Fatalf("failed to fetch MetaObject: %s", err)
+	}
+	added, err := meta.SignalID("serviceAdded", "(Is)")
+	if err != nil {
+		f.Fatalf("missing signal: %s", err)
+	}
+	var info bytes.Buffer
+	basic.WriteUint32(2, &info)
+	basic.WriteString("Rogue", &info)
+	event := net.NewMessage(net.NewHeader(net.Event, fuzz.DirectoryServiceID,
+		fuzz.DirectoryObjectID, added, 0), info.Bytes())
+	// send the event before answering the call to services.
+	services := -1
+	for i, m := range script {
+		if m.Header.Type == net.Reply &&
+			m.Header.Service == fuzz.DirectoryServiceID &&
+			m.Header.Object == fuzz.DirectoryObjectID &&
+			m.Header.Action == servicesActionID {
+			services = i
+			break
+		}
+	}
+	if services == -1 {
+		f.Fatalf("services reply not found in %d messages", len(script))
+	}
+	withEvent := append(fuzz.Session{}, script[:services]...)
+	withEvent = append(withEvent, event)
+	withEvent = append(withEvent, script[services:]...)
+	for _, s := range []fuzz.Session{script, withEvent} {
+		var buf bytes.Buffer
+		if err := s.Write(&buf); err != nil {
+			f.Fatalf("failed to write script: %s", err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.FuzzClient(data)
+	})
+}
@@ -0,0 +1,327 @@
+package fuzz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// A few bytes announcing a huge collection are enough to exhaust the
+// memory of the process. checkSizes detects those inputs: they are
+// reported as a memory exhaustion without crashing the process, or
+// skipped if the target enables SkipOversized in order to keep
+// exploring the rest of the decoders.
+
+// errOversized is returned when a collection announces more elements
+// than the remaining bytes can hold and more than maxElements.
+var errOversized = errors.New("oversized collection")
+
+// maxElements is the size above which a collection larger than its
+// input is considered a memory exhaustion: smaller ones only make the
+// decoder fail once it reaches the end of the input.
+const maxElements = 1 << 20
+
+// metaObjectSignature is the signature of a serialized MetaObject.
+const metaObjectSignature = "({I(Issss[(ss)<MetaMethodParameter,name,description>]s)" +
+	"<MetaMethod,uid,returnSignature,name,parametersSignature,description,parameters,returnDescription>}" +
+	"{I(Iss)<MetaSignal,uid,name,signature>}" +
+	"{I(Iss)<MetaProperty,uid,name,signature>}s)" +
+	"<MetaObject,methods,signals,properties,description>"
+
+var metaObjectType *capture.Type
+
+func init() {
+	var err error
+	metaObjectType, err = capture.ParseSignature(metaObjectSignature)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// minSize returns the size of the smallest value of type t.
+func minSize(t *capture.Type) int {
+	switch t.Kind {
+	case 'b', 'c', 'C', '+':
+		return 1
+	case 'w', 'W':
+		return 2
+	case 'i', 'I', 'f', 's', 'r', 'm', '[', '{', '#':
+		return 4
+	case 'l', 'L', 'd':
+		return 8
+	case 'o':
+		// empty MetaObject, service and object IDs.
+		return 24
+	case '(':
+		size := 0
+		for _, m := range t.Members {
+			size += minSize(m)
+		}
+		return size
+	default:
+		return 0
+	}
+}
+
+// readSize reads the size of a collection whose elements are at
+// least elemSize bytes long.
+func readSize(r *bytes.Reader, elemSize int) (int, error) {
+	size, err := basic.ReadUint32(r)
+	if err != nil {
+		return 0, err
+	}
+	if elemSize == 0 {
+		// bounds the walk of the collection.
+		elemSize = 1
+	}
+	if size > maxElements && uint64(size)*uint64(elemSize) > uint64(r.Len()) {
+		return 0, fmt.Errorf("%w: %d elements in %d bytes",
+			errOversized, size, r.Len())
+	}
+	return int(size), nil
+}
+
+// skip moves r forward by n bytes.
+func skip(r *bytes.Reader, n int) error {
+	if n > r.Len() {
+		return io.EOF
+	}
+	_, err := r.Seek(int64(n), io.SeekCurrent)
+	return err
+}
+
+// checkSizes walks the value of type t serialized in r and returns
+// errOversized if one of its collections announces more elements
+// than r contains. Other errors are left to the decoders.
+func checkSizes(t *capture.Type, r *bytes.Reader) error {
+	switch t.Kind {
+	case 's', 'r':
+		size, err := basic.ReadUint32(r)
+		if err != nil {
+			return err
+		}
+		return skip(r, int(size))
+	case 'm':
+		sig, err := basic.ReadString(r)
+		if err != nil {
+			return err
+		}
+		value, err := capture.ParseSignature(sig)
+		if err != nil {
+			return err
+		}
+		return checkSizes(value, r)
+	case 'o':
+		if err := checkSizes(metaObjectType, r); err != nil {
+			return err
+		}
+		return skip(r, 8)
+	case '+':
+		set, err := basic.ReadBool(r)
+		if err != nil || !set {
+			return err
+		}
+		return checkSizes(t.Members[0], r)
+	case '[', '#':
+		size, err := readSize(r, minSize(t.Members[0]))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err := checkSizes(t.Members[0], r); err != nil {
+				return err
+			}
+		}
+		return nil
+	case '{':
+		size, err := readSize(r, minSize(t.Members[0])+minSize(t.Members[1]))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			for _, m := range t.Members {
+				if err := checkSizes(m, r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case '(':
+		for _, m := range t.Members {
+			if err := checkSizes(m, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 'X':
+		return fmt.Errorf("unknown type")
+	default:
+		return skip(r, minSize(t))
+	}
+}
+
+// checkPayload returns errOversized if data announces a value of
+// signature sig larger than data.
+func checkPayload(sig string, data []byte) error {
+	t, err := capture.ParseSignature(sig)
+	if err != nil {
+		return nil
+	}
+	err = checkSizes(t, bytes.NewReader(data))
+	if errors.Is(err, errOversized) {
+		return err
+	}
+	return nil
+}
+
+// skipOversized returns true if err reports an oversized input and
+// the target skips those inputs. It panics with a memory exhaustion
+// if the target does not skip them.
+func skipOversized(err error) bool {
+	if err == nil {
+		return false
+	}
+	if currentTarget().SkipOversized {
+		return true
+	}
+	panic(fmt.Sprintf("%s: %s", KindMemory, err))
+}
+
+// isOversized returns true if data announces a MetaObject larger
+// than data and the target skips those inputs, see skipOversized.
+func isOversized(data []byte) bool {
+	return skipOversized(checkPayload(metaObjectSignature, data))
+}
+
+// FuzzObjectReference decodes data as an object reference and
+// encodes it back.
+func FuzzObjectReference(data []byte) int {
+	// an object reference starts with a MetaObject.
+	if isOversized(data) {
+		return -1
+	}
+	ref, err := object.ReadObjectReference(bytes.NewBuffer(data))
+	if err != nil {
+		return 0
+	}
+	var out bytes.Buffer
+	if err = object.WriteObjectReference(ref, &out); err != nil {
+		panic(err)
+	}
+	return 1
+}
+
+// useMetaObject exercises the MetaObject the way a client does when
+// it generates a proxy. The lookups can legitimately fail on a
+// random MetaObject: only the encoding error is returned.
+func useMetaObject(meta object.MetaObject) error {
+	var out bytes.Buffer
+	if err := object.WriteMetaObject(meta, &out); err != nil {
+		return err
+	}
+	meta.JSON()
+	meta.ForEachMethodAndSignal(
+		func(m object.MetaMethod, name string) error {
+			meta.MethodID(m.Name, m.ParametersSignature)
+			return nil
+		},
+		func(s object.MetaSignal, name string) error {
+			meta.SignalID(s.Name, s.Signature)
+			return nil
+		},
+		func(p object.MetaProperty, name string) error {
+			meta.PropertyID(p.Name, p.Signature)
+			return nil
+		},
+	)
+	return nil
+}
+
+// FuzzMetaObject decodes data as a MetaObject and uses it.
+func FuzzMetaObject(data []byte) int {
+	if isOversized(data) {
+		return -1
+	}
+	meta, err := object.ReadMetaObject(bytes.NewBuffer(data))
+	if err != nil {
+		return 0
+	}
+	if err = useMetaObject(meta); err != nil {
+		panic(err)
+	}
+	return 1
+}
+
+// rogueService answers every call received by endpoint with reply.
+func rogueService(endpoint net.EndPoint, reply []byte) {
+	filter := func(hdr *net.Header) (bool, bool) {
+		return hdr.Type == net.Call, true
+	}
+	consumer := func(msg *net.Message) error {
+		hdr := net.NewHeader(net.Reply, msg.Header.Service,
+			msg.Header.Object, msg.Header.Action, msg.Header.ID)
+		return endpoint.Send(net.NewMessage(hdr, reply))
+	}
+	endpoint.AddHandler(filter, consumer, nil)
+}
+
+// errMetaObjectTimeout is returned when the client does not process
+// the reply in time.
+var errMetaObjectTimeout = errors.New("metaObject timeout")
+
+// callMetaObject requests the MetaObject of a service answering
+// the metaObject method with reply.
+func callMetaObject(reply []byte) (object.MetaObject, error) {
+	server, endpoint := net.Pipe()
+	defer server.Close()
+	defer endpoint.Close()
+	rogueService(server, reply)
+
+	type result struct {
+		meta object.MetaObject
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		clt := bus.NewClient(bus.NewContext(endpoint))
+		meta, err := bus.GetMetaObject(clt, DirectoryServiceID,
+			DirectoryObjectID)
+		ch <- result{meta, err}
+	}()
+	timer := time.NewTimer(time.Duration(currentTarget().CallTimeout))
+	select {
+	case r := <-ch:
+		timer.Stop()
+		return r.meta, r.err
+	case <-timer.C:
+		return object.MetaObject{}, errMetaObjectTimeout
+	}
+}
+
+// FuzzMetaObjectReply sends data as the reply of a metaObject call
+// made by a client: it simulates a rogue service sending a malicious
+// MetaObject.
+func FuzzMetaObjectReply(data []byte) int {
+	if isOversized(data) {
+		return -1
+	}
+	meta, err := callMetaObject(data)
+	if err != nil {
+		if err == errMetaObjectTimeout {
+			panic(err.Error())
+		}
+		return 0
+	}
+	if err = useMetaObject(meta); err != nil {
+		panic(err)
+	}
+	return 1
+}
@@ -0,0 +1,132 @@
+package fuzz
+
+import (
+	"sync"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+)
+
+// poolSize is the maximum number of idle endpoints of each kind.
+const poolSize = 16
+
+// pooledEndPoint is a connection to the target kept open between the
+// inputs.
+type pooledEndPoint struct {
+	endpoint net.EndPoint
+	client   bus.Client
+	closed   chan struct{} // closed once the connection terminates
+}
+
+func newPooledEndPoint(endpoint net.EndPoint) *pooledEndPoint {
+	e := &pooledEndPoint{
+		endpoint: endpoint,
+		client:   bus.NewClient(bus.NewContext(endpoint)),
+		closed:   make(chan struct{}),
+	}
+	var once sync.Once
+	filter := func(hdr *net.Header) (matched bool, keep bool) {
+		return false, true
+	}
+	consumer := func(msg *net.Message) error {
+		return nil
+	}
+	closer := func(err error) {
+		once.Do(func() { close(e.closed) })
+	}
+	endpoint.AddHandler(filter, consumer, closer)
+	return e
+}
+
+// isClosed returns true if the connection has terminated.
+func (e *pooledEndPoint) isClosed() bool {
+	select {
+	case <-e.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close terminates the connection.
+func (e *pooledEndPoint) Close() error {
+	return e.endpoint.Close()
+}
+
+// Pool keeps connections to the target open between the inputs: a
+// connection is only reopened once closed. Two kinds of endpoints
+// are kept: unauthenticated ones, used to call the authenticate
+// method (the endpoints authenticated by an input are closed instead
+// of being returned), and authenticated ones. A Pool is safe for
+// concurrent use.
+type Pool struct {
+	mutex sync.Mutex
+	idle  map[bool][]*pooledEndPoint // indexed by authentication
+}
+
+// NewPool returns an empty pool.
+func NewPool() *Pool {
+	return &Pool{
+		idle: make(map[bool][]*pooledEndPoint),
+	}
+}
+
+// pool is used by the entry points to reach the target.
+var pool = NewPool()
+
+// get returns an idle endpoint, or connects a new one.
+func (p *Pool) get(authenticated bool) (*pooledEndPoint, error) {
+	p.mutex.Lock()
+	for len(p.idle[authenticated]) != 0 {
+		idle := p.idle[authenticated]
+		e := idle[len(idle)-1]
+		p.idle[authenticated] = idle[:len(idle)-1]
+		if !e.isClosed() {
+			p.mutex.Unlock()
+			return e, nil
+		}
+	}
+	p.mutex.Unlock()
+	return p.dial(authenticated)
+}
+
+// dial connects a new endpoint.
+func (p *Pool) dial(authenticated bool) (*pooledEndPoint, error) {
+	recordConnection()
+	var endpoint net.EndPoint
+	var err error
+	if authenticated {
+		endpoint, err = currentTarget().authenticate()
+	} else {
+		endpoint, err = currentTarget().dial()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newPooledEndPoint(endpoint), nil
+}
+
+// put returns an endpoint to the pool. Closed endpoints are
+// discarded.
+func (p *Pool) put(e *pooledEndPoint, authenticated bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if e.isClosed() || len(p.idle[authenticated]) >= poolSize {
+		e.Close()
+		return
+	}
+	p.idle[authenticated] = append(p.idle[authenticated], e)
+}
+
+// Reset closes the idle endpoints.
+func (p *Pool) Reset() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = make(map[bool][]*pooledEndPoint)
+	p.mutex.Unlock()
+	for _, endpoints := range idle {
+		for _, e := range endpoints {
+			e.Close()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// PingGateway returns an error if the target does not accept
+// connections or does not authenticate users within the
+// health-check timeout.
+func PingGateway() error {
+	return pingGateway()
+}
+
+// formatCapabilityMap returns the entries of cm sorted by key.
+func formatCapabilityMap(cm bus.CapabilityMap) string {
+	keys := make([]string, 0, len(cm))
+	for k := range cm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := make([]string, len(keys))
+	for i, k := range keys {
+		entries[i] = fmt.Sprintf("%q: %v (%s)", k, cm[k],
+			cm[k].Signature())
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+// formatPayload decodes the payload of a message sent by the server.
+func formatPayload(m net.Message) string {
+	switch m.Header.Type {
+	case net.Error:
+		v, err := value.NewValue(bytes.NewBuffer(m.Payload))
+		if err != nil {
+			return fmt.Sprintf("invalid error: %s", err)
+		}
+		return fmt.Sprintf("%v", v)
+	case net.Capability:
+		cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(m.Payload))
+		if err != nil {
+			return fmt.Sprintf("invalid capability map: %s", err)
+		}
+		return formatCapabilityMap(cm)
+	default:
+		return fmt.Sprintf("%x", m.Payload)
+	}
+}
+
+// replayAuth runs Fuzz with data and decodes the response.
+func replayAuth(data []byte) string {
+	_, response, err := fuzzAuth(data)
+	if err != nil {
+		return fmt.Sprintf("error: %s", err)
+	}
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(response))
+	if err != nil {
+		return fmt.Sprintf("invalid response: %s", err)
+	}
+	return fmt.Sprintf("reply: %s", formatCapabilityMap(cm))
+}
+
+// replaySerializer runs FuzzSerializer with data and returns the
+// capability map decoded.
+func replaySerializer(data []byte) string {
+	_, cm, err := fuzzSerializer(data)
+	if err != nil {
+		return fmt.Sprintf("invalid capability map: %s", err)
+	}
+	return fmt.Sprintf("decoded: %s", formatCapabilityMap(cm))
+}
+
+// replayMessage runs FuzzMessage with data and decodes the message
+// sent back by the server, if any.
+func replayMessage(data []byte) string {
+	ret, x := fuzzMessage(data)
+	switch {
+	case ret == -1:
+		return fmt.Sprintf("ignored: shorter than a header (%d bytes)", len(data))
+	case x.written != nil:
+		return fmt.Sprintf("connection closed: %s", x.written)
+	case x.read != nil:
+		return fmt.Sprintf("no answer: %s", x.read)
+	}
+	return fmt.Sprintf("%s %s", x.answer.Header, formatPayload(x.answer))
+}
+
+// Replay runs the entry point name with data and returns the decoded
+// response. The response of the auth, serializer and message entry
+// points is decoded; the return value of the others is reported. A
+// failure detected by the entry point, including a timeout, is
+// returned as an error.
+func Replay(name string, data []byte) (response string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(r)
+		}
+	}()
+	switch name {
+	case "auth":
+		return replayAuth(data), nil
+	case "serializer":
+		return replaySerializer(data), nil
+	case "message":
+		return replayMessage(data), nil
+	}
+	entry, ok := Targets[name]
+	if !ok {
+		return "", fmt.Errorf("unknown target: %s", name)
+	}
+	return fmt.Sprintf("returned %d", entry(data)), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/lugu/audit/fuzz"
+)
+
+func main() {
+	var target = flag.String("target", "auth",
+		"fuzz target: auth, serializer, message, ...")
+	var url = flag.String("url", "",
+		"server address (default: configuration or in-process server)")
+	flag.Parse()
+
+	if *url != "" {
+		t := fuzz.CurrentTarget()
+		t.URL = *url
+		fuzz.SetTarget(t)
+	}
+
+	failed := false
+	for _, filename := range flag.Args() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		response, err := fuzz.Replay(*target, data)
+		if err != nil {
+			fmt.Printf("%s: %s\n", filename, err)
+			failed = true
+		} else {
+			fmt.Printf("%s: %s\n", filename, response)
+		}
+		if err := fuzz.PingGateway(); err != nil {
+			fmt.Printf("%s: liveness check failed: %s\n", filename, err)
+			os.Exit(1)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
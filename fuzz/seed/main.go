@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/audit/fuzz"
+	"github.com/lugu/qiloop/bus/net"
+)
+
+// native associates the corpora with the Go native fuzz targets.
+var native = map[string][]string{
+	fuzz.CorpusCapability: {"FuzzCapabilityMap", "FuzzAuthenticateCall"},
+	fuzz.CorpusMessage:    {"FuzzMessage"},
+	fuzz.CorpusSession:    {"FuzzSession"},
+	fuzz.CorpusMetaObject: {"FuzzMetaObject", "FuzzMetaObjectReply"},
+	fuzz.CorpusPayload:    {"FuzzCapabilityMap", "FuzzAuthenticateCall"},
+}
+
+// write saves data in dir using the Go native corpus format if
+// isNative is true.
+func write(dir string, data []byte, isNative bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+	filename := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	if isNative {
+		data = []byte(fmt.Sprintf("go test fuzz v1\n[]byte(%q)\n", data))
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// readStreams returns the messages of a capture file, one sequence
+// per direction of each connection. Both the capture files and the
+// raw captures of a single direction are supported. The messages read
+// before an error are returned with the error.
+func readStreams(filename string) ([][]net.Message, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	magic, _ := r.Peek(len(capture.Magic))
+	if !capture.IsCapture(magic) {
+		session, err := fuzz.ReadSession(r)
+		return [][]net.Message{session}, err
+	}
+	records, err := capture.ReadAll(r)
+	streams := capture.Streams(records)
+	keys := make([]capture.Stream, 0, len(streams))
+	for s := range streams {
+		keys = append(keys, s)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Connection != keys[j].Connection {
+			return keys[i].Connection < keys[j].Connection
+		}
+		return keys[i].Direction < keys[j].Direction
+	})
+	messages := make([][]net.Message, len(keys))
+	for i, s := range keys {
+		messages[i] = streams[s]
+	}
+	return messages, err
+}
+
+func main() {
+	dir := "corpus"
+	flag.StringVar(&dir, "d", dir, "output directory")
+	var isNative = flag.Bool("native", false,
+		"write the corpora of the Go native fuzz targets (testdata/fuzz)")
+	flag.Parse()
+
+	for _, filename := range flag.Args() {
+		streams, err := readStreams(filename)
+		if err != nil {
+			if streams == nil {
+				log.Fatalf("%s", err)
+			}
+			log.Printf("%s: %s", filename, err)
+		}
+		count := make(map[string]int)
+		for _, messages := range streams {
+			for name, inputs := range fuzz.SeedCorpus(messages) {
+				dirs := []string{filepath.Join(dir, name)}
+				if *isNative {
+					dirs = nil
+					for _, target := range native[name] {
+						dirs = append(dirs, filepath.Join(dir, target))
+					}
+				}
+				for _, d := range dirs {
+					for _, data := range inputs {
+						if err := write(d, data, *isNative); err != nil {
+							log.Fatalf("%s", err)
+						}
+					}
+				}
+				count[name] += len(inputs)
+			}
+		}
+		names := make([]string, 0, len(count))
+		for name := range count {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s: %d %s input(s)\n", filename, count[name], name)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// Service and object IDs of the ServiceDirectory.
+const (
+	DirectoryServiceID = 1
+	DirectoryObjectID  = 1
+)
+
+// ActionStats summarizes the results of the fuzzing of an action.
+type ActionStats struct {
+	Action    uint32
+	Name      string
+	Signature string
+	Signal    bool
+	Calls     int // number of messages sent
+	Errors    int // calls answered with an error
+	Hangs     int // calls without answer before the timeout
+	Crashes   int // calls after which the server stopped working
+}
+
+func (s ActionStats) String() string {
+	kind := "method"
+	if s.Signal {
+		kind = "signal"
+	}
+	return fmt.Sprintf("%3d %s %s%s: calls %d, errors %d, hangs %d, crashes %d",
+		s.Action, kind, s.Name, s.Signature, s.Calls, s.Errors,
+		s.Hangs, s.Crashes)
+}
+
+// serviceFuzzer sends signature-aware payloads to the actions of an
+// object.
+type serviceFuzzer struct {
+	serviceID uint32
+	objectID  uint32
+	timeout   time.Duration
+	generator *Generator
+	endpoint  net.EndPoint
+	client    bus.Client
+	// restart is called with the input responsible for a crash. If
+	// nil, the fuzzing stops at the first crash.
+	restart func(input []byte, failure error) error
+}
+
+func (f *serviceFuzzer) connect() error {
+	if f.endpoint != nil {
+		f.endpoint.Close()
+	}
+	endpoint, err := currentTarget().authenticate()
+	if err != nil {
+		return err
+	}
+	f.endpoint = endpoint
+	f.client = bus.NewClient(bus.NewContext(endpoint))
+	return nil
+}
+
+// call sends the payload to a method. Returns true if the call did
+// not complete before the timeout.
+func (f *serviceFuzzer) call(action uint32, payload []byte) (bool, error) {
+	recordMessage(net.Call, payload)
+	start := time.Now()
+	cancel := make(chan struct{})
+	ch := make(chan error, 1)
+	go func() {
+		_, err := f.client.Call(cancel, f.serviceID, f.objectID,
+			action, payload)
+		ch <- err
+	}()
+	timer := time.NewTimer(f.timeout)
+	select {
+	case err := <-ch:
+		timer.Stop()
+		recordLatency(time.Since(start))
+		if err != nil {
+			recordError(err.Error())
+		}
+		return false, err
+	case <-timer.C:
+		close(cancel)
+		return true, nil
+	}
+}
+
+// post sends the payload as a signal.
+func (f *serviceFuzzer) post(action uint32, payload []byte) error {
+	hdr := net.NewHeader(net.Post, f.serviceID, f.objectID, action, 0)
+	recordMessage(net.Post, payload)
+	return f.endpoint.Send(net.NewMessage(hdr, payload))
+}
+
+// input returns the session sending payload to the action.
+func (f *serviceFuzzer) input(stats *ActionStats, payload []byte) []byte {
+	typ := net.Call
+	if stats.Signal {
+		typ = net.Post
+	}
+	hdr := net.NewHeader(typ, f.serviceID, f.objectID, stats.Action, 1)
+	var buf bytes.Buffer
+	Session{net.NewMessage(hdr, payload)}.Write(&buf)
+	return buf.Bytes()
+}
+
+func (f *serviceFuzzer) fuzzAction(stats *ActionStats, iterations int) error {
+	for i := 0; i < iterations; i++ {
+		payload, err := f.generator.MakePayload(stats.Signature, i%2 == 0)
+		if err != nil {
+			return err
+		}
+		stats.Calls++
+		if stats.Signal {
+			err = f.post(stats.Action, payload)
+		} else {
+			var hang bool
+			hang, err = f.call(stats.Action, payload)
+			if hang {
+				stats.Hangs++
+			}
+		}
+		if err != nil {
+			stats.Errors++
+		}
+		if err := pingGateway(); err != nil {
+			stats.Crashes++
+			failure := fmt.Errorf("%w after %s: %s", err, stats.Name,
+				stats.Signature)
+			if f.restart == nil {
+				return failure
+			}
+			err = f.restart(f.input(stats, payload), failure)
+			if err != nil {
+				return fmt.Errorf("%s (restart failed: %s)", failure, err)
+			}
+			if err := f.connect(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			// the connection may have been closed by the server.
+			if err := f.connect(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FetchMetaObject returns the MetaObject of an object of the
+// target.
+func FetchMetaObject(serviceID, objectID uint32) (object.MetaObject, error) {
+	e, err := pool.get(true)
+	if err != nil {
+		return object.MetaObject{}, err
+	}
+	meta, err := bus.GetMetaObject(e.client, serviceID, objectID)
+	if err != nil {
+		e.Close()
+		return meta, err
+	}
+	pool.put(e, true)
+	return meta, nil
+}
+
+// FuzzService fetches the MetaObject of an object of the target and
+// sends iterations payloads to each of its methods and
+// signals. The payloads are generated from the method (or signal)
+// signature by g, alternating valid and near-valid values. It returns
+// the statistics of each action sorted by action ID. In case the
+// server stops working, FuzzService returns the statistics collected
+// so far with an error.
+func FuzzService(g *Generator, serviceID, objectID uint32,
+	iterations int) ([]ActionStats, error) {
+	return fuzzService(g, serviceID, objectID, iterations, nil)
+}
+
+func fuzzService(g *Generator, serviceID, objectID uint32, iterations int,
+	restart func([]byte, error) error) ([]ActionStats, error) {
+	meta, err := FetchMetaObject(serviceID, objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &serviceFuzzer{
+		serviceID: serviceID,
+		objectID:  objectID,
+		timeout:   time.Duration(currentTarget().CallTimeout),
+		generator: g,
+		restart:   restart,
+	}
+	if err := f.connect(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		f.endpoint.Close()
+	}()
+
+	actions := make([]ActionStats, 0)
+	for id, m := range meta.Methods {
+		actions = append(actions, ActionStats{
+			Action:    id,
+			Name:      m.Name,
+			Signature: m.ParametersSignature,
+		})
+	}
+	for id, s := range meta.Signals {
+		actions = append(actions, ActionStats{
+			Action:    id,
+			Name:      s.Name,
+			Signature: s.Signature,
+			Signal:    true,
+		})
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Action < actions[j].Action
+	})
+
+	for i := range actions {
+		err := f.fuzzAction(&actions[i], iterations)
+		if err != nil {
+			return actions, err
+		}
+	}
+	return actions, nil
+}
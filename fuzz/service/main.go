@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lugu/audit/fuzz"
+)
+
+func main() {
+	serviceID := flag.Uint("service", fuzz.DirectoryServiceID, "service ID")
+	objectID := flag.Uint("object", fuzz.DirectoryObjectID, "object ID")
+	iterations := flag.Int("n", 100, "number of calls per action")
+	report := flag.String("report", "", "directory of the statistics report")
+	cover := flag.String("cover", "", "directory of the coverage data (binary built with -cover)")
+	seed := flag.Int64("seed", 0, "random seed (0 for a random one)")
+	flag.Parse()
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("seed: %d", *seed)
+	generator := fuzz.NewGenerator(*seed)
+
+	actions, err := fuzz.FuzzService(generator, uint32(*serviceID),
+		uint32(*objectID), *iterations)
+	for _, s := range actions {
+		fmt.Println(s)
+	}
+	stats := fuzz.CurrentStats()
+	if *cover != "" {
+		if err := fuzz.WriteCoverage(*cover); err != nil {
+			log.Printf("coverage: %s", err)
+		} else if stats.Coverage, err = fuzz.ReadCoverage(*cover); err != nil {
+			log.Printf("coverage: %s", err)
+		}
+	}
+	if *report != "" {
+		if err := stats.WriteReport(*report); err != nil {
+			log.Printf("failed to write report: %s", err)
+		}
+	}
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+}
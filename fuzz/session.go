@@ -0,0 +1,212 @@
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	gofuzz "github.com/google/gofuzz"
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// Session is a sequence of messages sent over a single authenticated
+// connection.
+type Session []net.Message
+
+// Write serializes the session using the qimessaging wire format:
+// the messages are simply concatenated.
+func (s Session) Write(w io.Writer) error {
+	for i, m := range s {
+		if err := m.Write(w); err != nil {
+			return fmt.Errorf("write message %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// ReadSession reads the messages of a session until the end of r. It
+// stops at the first invalid message: the messages read so far are
+// returned with the error.
+func ReadSession(r io.Reader) (Session, error) {
+	session := make(Session, 0)
+	for {
+		var m net.Message
+		err := m.Read(r)
+		if err == io.EOF {
+			return session, nil
+		} else if err != nil {
+			return session, fmt.Errorf("read message %d: %s",
+				len(session), err)
+		}
+		session = append(session, m)
+	}
+}
+
+// sessionRequest is the input of makeSession.
+type sessionRequest struct {
+	meta      object.MetaObject
+	serviceID uint32
+	objectID  uint32
+	size      int
+	session   Session
+}
+
+func makeSession(r *sessionRequest, c gofuzz.Continue) {
+	methods := make([]uint32, 0, len(r.meta.Methods))
+	for id := range r.meta.Methods {
+		methods = append(methods, id)
+	}
+	signals := make([]uint32, 0, len(r.meta.Signals))
+	for id := range r.meta.Signals {
+		signals = append(signals, id)
+	}
+	sortActions(methods)
+	sortActions(signals)
+	calls := make([]uint32, 0)
+	nextID := uint32(100)
+
+	// the kinds of message not supported by the object are drawn
+	// again: the session always contains size messages.
+	r.session = make(Session, 0, r.size)
+	for len(r.session) < r.size {
+		hdr := net.NewHeader(net.Call, r.serviceID, r.objectID, 0, nextID)
+		var payload []byte
+		switch c.Intn(5) {
+		case 0, 1:
+			if len(methods) == 0 {
+				continue
+			}
+			hdr.Action = methods[c.Intn(len(methods))]
+			sig := r.meta.Methods[hdr.Action].ParametersSignature
+			payload = makeSignaturePayload(sig, c)
+			calls = append(calls, hdr.ID)
+		case 2:
+			if len(signals) == 0 {
+				continue
+			}
+			hdr.Type = net.Post
+			if c.RandBool() {
+				hdr.Type = net.Event
+			}
+			hdr.Action = signals[c.Intn(len(signals))]
+			sig := r.meta.Signals[hdr.Action].Signature
+			payload = makeSignaturePayload(sig, c)
+		case 3:
+			hdr.Type = net.Cancel
+			target := c.Uint32()
+			if len(calls) != 0 {
+				target = calls[c.Intn(len(calls))]
+			}
+			var buf bytes.Buffer
+			basic.WriteUint32(target, &buf)
+			payload = buf.Bytes()
+		case 4:
+			hdr.Type = net.Capability
+			hdr.Service, hdr.Object, hdr.Action = 0, 0, 0
+			var cm bus.CapabilityMap
+			c.Fuzz(&cm)
+			var buf bytes.Buffer
+			WriteSortedCapabilityMap(cm, &buf)
+			payload = buf.Bytes()
+		}
+		nextID++
+		if c.Intn(10) == 0 {
+			// reuse a message ID
+			hdr.ID = 100 + uint32(c.Intn(int(nextID-100)))
+		}
+		r.session = append(r.session, net.NewMessage(hdr, payload))
+	}
+}
+
+func sortActions(actions []uint32) {
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i] < actions[j]
+	})
+}
+
+// makeSignaturePayload returns a valid or near-valid payload
+// matching sig.
+func makeSignaturePayload(sig string, c gofuzz.Continue) []byte {
+	t, err := capture.ParseSignature(sig)
+	if err != nil {
+		var garbage []byte
+		c.Fuzz(&garbage)
+		return garbage
+	}
+	p := payload{typ: t, valid: c.Intn(4) != 0}
+	makePayload(&p, c)
+	return p.data
+}
+
+// MakeSession generates a sequence of size messages targeting the
+// object described by meta: calls to its methods, posts and events
+// of its signals, cancellations of the previous calls and capability
+// maps.
+func (g *Generator) MakeSession(meta object.MetaObject, serviceID,
+	objectID uint32, size int) Session {
+	r := sessionRequest{
+		meta:      meta,
+		serviceID: serviceID,
+		objectID:  objectID,
+		size:      size,
+	}
+	g.fuzzer.Fuzz(&r)
+	return r.session
+}
+
+// MakeSession generates a session using the default generator.
+func MakeSession(meta object.MetaObject, serviceID, objectID uint32,
+	size int) Session {
+	generatorMutex.Lock()
+	defer generatorMutex.Unlock()
+	return generator.MakeSession(meta, serviceID, objectID, size)
+}
+
+// RunSession authenticates to the target and sends the
+// messages of the session over the same connection. It returns an
+// error if the server stops working.
+func RunSession(session Session) error {
+	endpoint, err := currentTarget().authenticate()
+	if err != nil {
+		return err
+	}
+	defer endpoint.Close()
+
+	// discard the responses.
+	filter := func(hdr *net.Header) (matched bool, keep bool) {
+		return true, true
+	}
+	consumer := func(msg *net.Message) error {
+		if msg.Header.Type == net.Error {
+			recordErrorMessage(msg.Payload)
+		}
+		return nil
+	}
+	endpoint.AddHandler(filter, consumer, nil)
+
+	for _, m := range session {
+		recordMessage(m.Header.Type, m.Payload)
+		if err := endpoint.Send(m); err != nil {
+			// the server closed the connection
+			break
+		}
+	}
+	return pingGateway()
+}
+
+// FuzzSession interprets data as a session and runs it.
+func FuzzSession(data []byte) int {
+	session, err := ReadSession(bytes.NewBuffer(data))
+	if err != nil || len(session) == 0 {
+		return -1
+	}
+	if err := RunSession(session); err != nil {
+		panic(err.Error())
+	}
+	return 1
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lugu/audit/fuzz"
+)
+
+func replay(filename string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	session, err := fuzz.ReadSession(bytes.NewBuffer(data))
+	if err != nil {
+		log.Fatalf("%s: %s", filename, err)
+	}
+	if err := fuzz.RunSession(session); err != nil {
+		log.Fatalf("%s: %s", filename, err)
+	}
+	log.Printf("%s: %d messages, no failure", filename, len(session))
+}
+
+func main() {
+	dir := "crashers"
+	flag.StringVar(&dir, "d", dir, "output directory")
+	var serviceID = flag.Uint("service", fuzz.DirectoryServiceID, "service ID")
+	var objectID = flag.Uint("object", fuzz.DirectoryObjectID, "object ID")
+	var iterations = flag.Int("n", 100, "number of sessions")
+	var size = flag.Int("size", 50, "number of messages per session")
+	var filename = flag.String("replay", "", "session file to replay")
+	var seed = flag.Int64("seed", 0, "random seed (0 for a random one)")
+	flag.Parse()
+
+	if *filename != "" {
+		replay(*filename)
+		return
+	}
+
+	meta, err := fuzz.FetchMetaObject(uint32(*serviceID),
+		uint32(*objectID))
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("seed: %d", *seed)
+	generator := fuzz.NewGenerator(*seed)
+	for i := 0; i < *iterations; i++ {
+		session := generator.MakeSession(meta, uint32(*serviceID),
+			uint32(*objectID), *size)
+		failure := fuzz.RunSession(session)
+		if failure == nil {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatalf("%s", err)
+		}
+		file, err := ioutil.TempFile(dir, "session-*.bin")
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		if err = session.Write(file); err != nil {
+			log.Fatalf("failed to record session: %s", err)
+		}
+		file.Close()
+		log.Fatalf("session %d: %s (recorded in %s)", i, failure,
+			file.Name())
+	}
+}
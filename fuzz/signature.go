@@ -0,0 +1,204 @@
+package fuzz
+
+import (
+	"bytes"
+	"io"
+
+	gofuzz "github.com/google/gofuzz"
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// payload is the input of makePayload.
+type payload struct {
+	typ   *capture.Type
+	valid bool
+	data  []byte
+}
+
+// payloadWriter serializes random values following a type
+// signature. The node number corrupt is serialized incorrectly.
+type payloadWriter struct {
+	c       gofuzz.Continue
+	corrupt int
+	count   int
+}
+
+func makePayload(p *payload, c gofuzz.Continue) {
+	w := payloadWriter{c: c, corrupt: -1}
+	if !p.valid {
+		w.corrupt = c.Intn(8)
+	}
+	var buf bytes.Buffer
+	w.write(p.typ, &buf)
+	p.data = buf.Bytes()
+	if !p.valid && w.count <= w.corrupt {
+		// the corrupted node was not reached: alter the end of
+		// the payload instead.
+		if len(p.data) > 0 && c.RandBool() {
+			p.data = p.data[:c.Intn(len(p.data))]
+		} else {
+			var garbage []byte
+			c.Fuzz(&garbage)
+			p.data = append(p.data, garbage...)
+		}
+	}
+}
+
+// MakePayload returns a random value of type sig serialized. If
+// valid is false, the payload is near-valid: one element of the
+// value is incorrectly serialized (wrong size, truncated data,
+// wrong embedded signature, ...).
+func (g *Generator) MakePayload(sig string, valid bool) ([]byte, error) {
+	t, err := capture.ParseSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	p := payload{typ: t, valid: valid}
+	g.fuzzer.Fuzz(&p)
+	return p.data, nil
+}
+
+// MakePayload returns a random value of type sig using the default
+// generator.
+func MakePayload(sig string, valid bool) ([]byte, error) {
+	generatorMutex.Lock()
+	defer generatorMutex.Unlock()
+	return generator.MakePayload(sig, valid)
+}
+
+func (p *payloadWriter) write(t *capture.Type, w io.Writer) {
+	n := p.count
+	p.count++
+	if n == p.corrupt {
+		p.writeCorrupted(t, w)
+		return
+	}
+	c := p.c
+	switch t.Kind {
+	case 'b':
+		var b bool
+		c.Fuzz(&b)
+		basic.WriteBool(b, w)
+	case 'c', 'C':
+		var u uint8
+		c.Fuzz(&u)
+		basic.WriteUint8(u, w)
+	case 'w', 'W':
+		var u uint16
+		c.Fuzz(&u)
+		basic.WriteUint16(u, w)
+	case 'i', 'I':
+		var u uint32
+		c.Fuzz(&u)
+		basic.WriteUint32(u, w)
+	case 'l', 'L':
+		var u uint64
+		c.Fuzz(&u)
+		basic.WriteUint64(u, w)
+	case 'f':
+		var f float32
+		c.Fuzz(&f)
+		basic.WriteFloat32(f, w)
+	case 'd':
+		var f float64
+		c.Fuzz(&f)
+		basic.WriteFloat64(f, w)
+	case 's':
+		var s string
+		c.Fuzz(&s)
+		basic.WriteString(s, w)
+	case 'r':
+		var b []byte
+		c.Fuzz(&b)
+		basic.WriteUint32(uint32(len(b)), w)
+		w.Write(b)
+	case 'm', 'X':
+		var v value.Value
+		makeValue(&v, c)
+		v.Write(w)
+	case 'o':
+		var ref object.ObjectReference
+		c.Fuzz(&ref)
+		writeSortedObjectReference(ref, w)
+	case 'v':
+	case '+':
+		present := c.RandBool()
+		basic.WriteBool(present, w)
+		if present {
+			p.write(t.Members[0], w)
+		}
+	case '[', '{', '#':
+		size := c.Intn(7)
+		basic.WriteUint32(uint32(size), w)
+		for i := 0; i < size; i++ {
+			for _, m := range t.Members {
+				p.write(m, w)
+			}
+		}
+	case '(':
+		for _, m := range t.Members {
+			p.write(m, w)
+		}
+	}
+}
+
+func (p *payloadWriter) writeCorrupted(t *capture.Type, w io.Writer) {
+	c := p.c
+	switch t.Kind {
+	case 'b':
+		// not a boolean
+		basic.WriteUint8(uint8(2+c.Intn(254)), w)
+	case 'c', 'C', 'v':
+		// not enough or too many bytes
+		basic.WriteUint16(uint16(c.Uint32()), w)
+	case 'w', 'W', 'i', 'I', 'f', 'l', 'L', 'd':
+		var buf bytes.Buffer
+		p.write(t, &buf)
+		w.Write(buf.Bytes()[:1])
+	case 's', 'r':
+		// size larger than the data
+		var s string
+		c.Fuzz(&s)
+		basic.WriteUint32(uint32(len(s)+1+c.Intn(1<<16)), w)
+		w.Write([]byte(s))
+	case 'm', 'X':
+		// signature does not match the data
+		var v value.Value
+		makeValue(&v, c)
+		other := string(capture.BasicKinds[c.Intn(len(capture.BasicKinds))])
+		if c.RandBool() {
+			other = cleanName(c)
+		}
+		basic.WriteString(other, w)
+		w.Write(value.Bytes(v))
+	case 'o':
+		var buf bytes.Buffer
+		p.write(t, &buf)
+		w.Write(buf.Bytes()[:c.Intn(buf.Len())])
+	case '+':
+		basic.WriteUint8(uint8(2+c.Intn(254)), w)
+		p.write(t.Members[0], w)
+	case '[', '{', '#':
+		// announce more elements than present
+		size := c.Intn(7)
+		sizes := []uint32{uint32(size + 1), 0x7fffffff, 0xffffffff}
+		basic.WriteUint32(sizes[c.Intn(len(sizes))], w)
+		for i := 0; i < size; i++ {
+			for _, m := range t.Members {
+				p.write(m, w)
+			}
+		}
+	case '(':
+		// missing member
+		if len(t.Members) == 0 {
+			basic.WriteUint32(c.Uint32(), w)
+			return
+		}
+		for _, m := range t.Members[:len(t.Members)-1] {
+			p.write(m, w)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package fuzz
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/type/basic"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// The encoders of qiloop iterate over Go maps: the same value is not
+// always serialized the same way. The functions below sort the keys
+// in order to produce reproducible inputs.
+
+// WriteSortedCapabilityMap serializes cm like bus.WriteCapabilityMap
+// with the keys sorted.
+func WriteSortedCapabilityMap(cm bus.CapabilityMap, w io.Writer) error {
+	keys := make([]string, 0, len(cm))
+	for k := range cm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if err := basic.WriteUint32(uint32(len(cm)), w); err != nil {
+		return fmt.Errorf("write map size: %s", err)
+	}
+	for _, k := range keys {
+		if err := basic.WriteString(k, w); err != nil {
+			return fmt.Errorf("write map key: %s", err)
+		}
+		if err := cm[k].Write(w); err != nil {
+			return fmt.Errorf("write map value: %s", err)
+		}
+	}
+	return nil
+}
+
+// writeMetaMethod serializes m like the MetaMethod entries of
+// object.WriteMetaObject.
+func writeMetaMethod(m object.MetaMethod, w io.Writer) error {
+	if err := basic.WriteUint32(m.Uid, w); err != nil {
+		return err
+	}
+	for _, s := range []string{m.ReturnSignature, m.Name,
+		m.ParametersSignature, m.Description} {
+		if err := basic.WriteString(s, w); err != nil {
+			return err
+		}
+	}
+	if err := basic.WriteUint32(uint32(len(m.Parameters)), w); err != nil {
+		return err
+	}
+	for _, p := range m.Parameters {
+		if err := basic.WriteString(p.Name, w); err != nil {
+			return err
+		}
+		if err := basic.WriteString(p.Description, w); err != nil {
+			return err
+		}
+	}
+	return basic.WriteString(m.ReturnDescription, w)
+}
+
+// writeMetaSignal serializes s like the MetaSignal entries of
+// object.WriteMetaObject.
+func writeMetaSignal(s object.MetaSignal, w io.Writer) error {
+	if err := basic.WriteUint32(s.Uid, w); err != nil {
+		return err
+	}
+	if err := basic.WriteString(s.Name, w); err != nil {
+		return err
+	}
+	return basic.WriteString(s.Signature, w)
+}
+
+// writeMetaProperty serializes p like the MetaProperty entries of
+// object.WriteMetaObject.
+func writeMetaProperty(p object.MetaProperty, w io.Writer) error {
+	if err := basic.WriteUint32(p.Uid, w); err != nil {
+		return err
+	}
+	if err := basic.WriteString(p.Name, w); err != nil {
+		return err
+	}
+	return basic.WriteString(p.Signature, w)
+}
+
+// writeSortedMetaObject serializes meta like object.WriteMetaObject
+// with the actions sorted by ID.
+func writeSortedMetaObject(meta object.MetaObject, w io.Writer) error {
+	methods := make([]uint32, 0, len(meta.Methods))
+	for id := range meta.Methods {
+		methods = append(methods, id)
+	}
+	signals := make([]uint32, 0, len(meta.Signals))
+	for id := range meta.Signals {
+		signals = append(signals, id)
+	}
+	properties := make([]uint32, 0, len(meta.Properties))
+	for id := range meta.Properties {
+		properties = append(properties, id)
+	}
+	sortActions(methods)
+	sortActions(signals)
+	sortActions(properties)
+
+	if err := basic.WriteUint32(uint32(len(methods)), w); err != nil {
+		return err
+	}
+	for _, id := range methods {
+		if err := basic.WriteUint32(id, w); err != nil {
+			return err
+		}
+		if err := writeMetaMethod(meta.Methods[id], w); err != nil {
+			return err
+		}
+	}
+	if err := basic.WriteUint32(uint32(len(signals)), w); err != nil {
+		return err
+	}
+	for _, id := range signals {
+		if err := basic.WriteUint32(id, w); err != nil {
+			return err
+		}
+		if err := writeMetaSignal(meta.Signals[id], w); err != nil {
+			return err
+		}
+	}
+	if err := basic.WriteUint32(uint32(len(properties)), w); err != nil {
+		return err
+	}
+	for _, id := range properties {
+		if err := basic.WriteUint32(id, w); err != nil {
+			return err
+		}
+		if err := writeMetaProperty(meta.Properties[id], w); err != nil {
+			return err
+		}
+	}
+	return basic.WriteString(meta.Description, w)
+}
+
+// writeSortedObjectReference serializes ref like
+// object.WriteObjectReference with the actions of its MetaObject
+// sorted by ID.
+func writeSortedObjectReference(ref object.ObjectReference, w io.Writer) error {
+	if err := writeSortedMetaObject(ref.MetaObject, w); err != nil {
+		return err
+	}
+	if err := basic.WriteUint32(ref.ServiceID, w); err != nil {
+		return err
+	}
+	return basic.WriteUint32(ref.ObjectID, w)
+}
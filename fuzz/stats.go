@@ -0,0 +1,329 @@
+package fuzz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// The entry points record what they send to the server and what the
+// server answers. The statistics are accumulated until ResetStats
+// and reported at the end of a campaign.
+
+// latencyBuckets are the upper bounds of the latency histogram.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Bucket counts the answers received within a latency bound. The
+// last bucket of a histogram has no bound.
+type Bucket struct {
+	Max   Duration `json:"max,omitempty"`
+	Count int      `json:"count"`
+}
+
+// Stats summarizes the activity of a fuzz campaign.
+type Stats struct {
+	Start    time.Time `json:"start"`
+	Duration Duration  `json:"duration"`
+	Runs     int       `json:"runs"`
+	// Connections counts the connections opened by the pool.
+	Connections int            `json:"connections"`
+	Results     map[string]int `json:"results"`  // return values of the entry points
+	Messages    map[string]int `json:"messages"` // messages sent by type
+	// CapabilityKeys counts the keys of the capability maps sent
+	// to the server.
+	CapabilityKeys map[string]int `json:"capability_keys"`
+	Errors         map[string]int `json:"errors"` // error messages returned by the server
+	Latency        []Bucket       `json:"latency"`
+	// Coverage maps the packages to their statement coverage in
+	// percent. Only set for binaries built with -cover.
+	Coverage map[string]float64 `json:"coverage,omitempty"`
+}
+
+func newStats() Stats {
+	latency := make([]Bucket, len(latencyBuckets)+1)
+	for i, max := range latencyBuckets {
+		latency[i].Max = Duration(max)
+	}
+	return Stats{
+		Start:          time.Now(),
+		Results:        make(map[string]int),
+		Messages:       make(map[string]int),
+		CapabilityKeys: make(map[string]int),
+		Errors:         make(map[string]int),
+		Latency:        latency,
+	}
+}
+
+var (
+	statsMutex sync.Mutex
+	stats      = newStats()
+)
+
+// ResetStats discards the statistics collected so far.
+func ResetStats() {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	stats = newStats()
+}
+
+// CurrentStats returns a copy of the statistics collected since the
+// beginning of the campaign.
+func CurrentStats() Stats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	s := stats
+	s.Duration = Duration(time.Since(s.Start))
+	s.Results = copyCounts(stats.Results)
+	s.Messages = copyCounts(stats.Messages)
+	s.CapabilityKeys = copyCounts(stats.CapabilityKeys)
+	s.Errors = copyCounts(stats.Errors)
+	s.Latency = append([]Bucket{}, stats.Latency...)
+	return s
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	c := make(map[string]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// resultName returns the name of the value returned by an entry
+// point.
+func resultName(ret int) string {
+	switch ret {
+	case -1:
+		return "skipped"
+	case 0:
+		return "rejected"
+	case 1:
+		return "accepted"
+	default:
+		return fmt.Sprintf("%d", ret)
+	}
+}
+
+// recordRun records the value returned by an entry point. A panic
+// is recorded as a failure.
+func recordRun(ret int, failure error) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	stats.Runs++
+	if failure != nil {
+		stats.Results["failed"]++
+		return
+	}
+	stats.Results[resultName(ret)]++
+}
+
+// recordConnection records a connection opened to the target.
+func recordConnection() {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	stats.Connections++
+}
+
+// messageType returns the name of a message type.
+func messageType(typ uint8) string {
+	switch typ {
+	case net.Call:
+		return "call"
+	case net.Reply:
+		return "reply"
+	case net.Error:
+		return "error"
+	case net.Post:
+		return "post"
+	case net.Event:
+		return "event"
+	case net.Capability:
+		return "capability"
+	case net.Cancel:
+		return "cancel"
+	case net.Cancelled:
+		return "cancelled"
+	default:
+		return fmt.Sprintf("unknown (%d)", typ)
+	}
+}
+
+// recordMessage records a message sent with its payload. The keys
+// of the capability maps are recorded as well.
+func recordMessage(typ uint8, payload []byte) {
+	statsMutex.Lock()
+	stats.Messages[messageType(typ)]++
+	statsMutex.Unlock()
+	if typ == net.Capability {
+		recordCapabilityMap(payload)
+	}
+}
+
+// recordCapabilityMap records the keys of the capability map
+// serialized in data, if any.
+func recordCapabilityMap(data []byte) {
+	if checkPayload("{sm}", data) != nil {
+		return
+	}
+	cm, err := bus.ReadCapabilityMap(bytes.NewBuffer(data))
+	if err != nil {
+		return
+	}
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	for key := range cm {
+		stats.CapabilityKeys[key]++
+	}
+}
+
+var digitsExp = regexp.MustCompile(`[0-9]+`)
+
+// errorKey groups the error messages which only differ by the values
+// of the input: the numbers are replaced with N and the text
+// following a non-ASCII value is dropped.
+func errorKey(msg string) string {
+	msg = digitsExp.ReplaceAllString(msg, "N")
+	parts := strings.Split(msg, ": ")
+	for i, part := range parts {
+		for _, r := range part {
+			if r < ' ' || r > '~' {
+				return strings.Join(append(parts[:i], "..."), ": ")
+			}
+		}
+	}
+	return msg
+}
+
+// recordError records an error message returned by the server.
+func recordError(msg string) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	stats.Errors[errorKey(msg)]++
+}
+
+// recordErrorMessage records the error carried by the payload of an
+// error message.
+func recordErrorMessage(payload []byte) {
+	if checkPayload("m", payload) != nil {
+		return
+	}
+	v, err := value.NewValue(bytes.NewBuffer(payload))
+	if err != nil {
+		return
+	}
+	if s, ok := v.(value.StringValue); ok {
+		recordError(string(s))
+	}
+}
+
+// recordLatency records the time taken by the server to answer.
+func recordLatency(d time.Duration) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	for i, max := range latencyBuckets {
+		if d <= max {
+			stats.Latency[i].Count++
+			return
+		}
+	}
+	stats.Latency[len(latencyBuckets)].Count++
+}
+
+// WriteJSON writes the statistics as an indented JSON document.
+func (s Stats) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// writeCounts writes the counters of m sorted by decreasing count.
+// At most max entries are written, 0 meaning no limit.
+func writeCounts(w io.Writer, title string, m map[string]int, max int) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	fmt.Fprintf(w, "%s (%d):\n", title, len(keys))
+	for i, k := range keys {
+		if max != 0 && i == max {
+			fmt.Fprintf(w, "\t... %d more\n", len(keys)-max)
+			break
+		}
+		fmt.Fprintf(w, "\t%8d %q\n", m[k], k)
+	}
+}
+
+func (s Stats) String() string {
+	var w strings.Builder
+	fmt.Fprintf(&w, "start: %s\n", s.Start.Format(time.RFC3339))
+	fmt.Fprintf(&w, "duration: %s\n", time.Duration(s.Duration))
+	fmt.Fprintf(&w, "runs: %d\n", s.Runs)
+	fmt.Fprintf(&w, "connections: %d\n", s.Connections)
+	writeCounts(&w, "results", s.Results, 0)
+	writeCounts(&w, "messages", s.Messages, 0)
+	writeCounts(&w, "capability keys", s.CapabilityKeys, 20)
+	writeCounts(&w, "errors", s.Errors, 20)
+	fmt.Fprintf(&w, "latency:\n")
+	for _, b := range s.Latency {
+		if b.Max == 0 {
+			fmt.Fprintf(&w, "\t> %-8s %d\n",
+				latencyBuckets[len(latencyBuckets)-1], b.Count)
+			continue
+		}
+		fmt.Fprintf(&w, "\t<= %-7s %d\n", time.Duration(b.Max), b.Count)
+	}
+	if len(s.Coverage) != 0 {
+		pkgs := make([]string, 0, len(s.Coverage))
+		for pkg := range s.Coverage {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+		fmt.Fprintf(&w, "coverage:\n")
+		for _, pkg := range pkgs {
+			fmt.Fprintf(&w, "\t%5.1f%% %s\n", s.Coverage[pkg], pkg)
+		}
+	}
+	return w.String()
+}
+
+// WriteReport writes the statistics in dir as stats.json and
+// stats.txt.
+func (s Stats) WriteReport(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(filepath.Join(dir, "stats.json"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := s.WriteJSON(file); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "stats.txt"),
+		[]byte(s.String()), 0644)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lugu/audit/fuzz"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/util"
+)
+
+// inputs returns the content of the corpus files.
+func inputs(files []string, n int) [][]byte {
+	data := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		input, err := ioutil.ReadFile(files[i%len(files)])
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		data = append(data, input)
+	}
+	return data
+}
+
+// makeCap returns a random capability map serialized.
+func makeCap(g *fuzz.Generator) []byte {
+	var buf bytes.Buffer
+	err := bus.WriteCapabilityMap(g.MakeCap(), &buf)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return buf.Bytes()
+}
+
+func main() {
+	dir := "restarts"
+	flag.StringVar(&dir, "d", dir, "directory of the inputs causing a restart")
+	var target = flag.String("target", "auth",
+		"fuzz target: "+strings.Join(fuzz.TargetNames(), ", "))
+	var iterations = flag.Int("n", 100, "number of inputs")
+	var workers = flag.Int("j", 1, "number of concurrent workers")
+	var url = flag.String("url", util.NewUnixAddr(), "server address")
+	var serve = flag.Bool("serve", false, "run the server")
+	var report = flag.String("report", "", "directory of the statistics report")
+	var watch = flag.Bool("watch", false, "report the inputs leaking resources")
+	var seed = flag.Int64("seed", 0,
+		"random seed of the generated inputs (0 for a random one)")
+	flag.Parse()
+	if *workers < 1 {
+		log.Fatalf("invalid number of workers: %d", *workers)
+	}
+
+	config := fuzz.CurrentTarget()
+	if *serve {
+		err := fuzz.ServeDirectory(*url, config.User, config.Token)
+		if err != nil {
+			log.Fatalf("Server: failed with error %s", err)
+		}
+		return
+	}
+
+	entry, ok := fuzz.Targets[*target]
+	if !ok {
+		log.Fatalf("unknown target: %s", *target)
+	}
+
+	command := []string{os.Args[0], "-serve", "-url", *url}
+	supervisor := fuzz.NewSupervisor(command, *url, dir)
+	supervisor.Watch = *watch
+	if err := supervisor.Start(); err != nil {
+		log.Fatalf("%s", err)
+	}
+	defer supervisor.Stop()
+
+	var failures []error
+	if flag.NArg() != 0 {
+		data := inputs(flag.Args(), *iterations)
+		failures = supervisor.RunWorkers(entry, data, *workers)
+	} else {
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		log.Printf("seed: %d", *seed)
+		failures = supervisor.RunGenerated(entry, makeCap, *iterations,
+			*workers, *seed)
+	}
+	for i, err := range failures {
+		if err != nil {
+			log.Printf("input %d: %s", i, err)
+		}
+	}
+	for _, r := range supervisor.Restarts {
+		fmt.Printf("%s: %s: %s (%s)\n", r.Time.Format("15:04:05"),
+			r.Kind, r.Reason, r.Input)
+	}
+	fmt.Printf("%d restart(s)\n", len(supervisor.Restarts))
+	if *report != "" {
+		if err := fuzz.CurrentStats().WriteReport(*report); err != nil {
+			log.Fatalf("failed to write report: %s", err)
+		}
+	}
+}
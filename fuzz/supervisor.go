@@ -0,0 +1,347 @@
+package fuzz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	dir "github.com/lugu/qiloop/bus/directory"
+)
+
+// ServeDirectory runs a ServiceDirectory listening on addr until it
+// terminates.
+func ServeDirectory(addr, user, token string) error {
+	server, err := dir.NewServer(addr, bus.Dictionary(
+		map[string]string{
+			user: token,
+		},
+	))
+	if err != nil {
+		return err
+	}
+	return <-server.WaitTerminate()
+}
+
+// Restart records an input after which the server was restarted.
+type Restart struct {
+	Time   time.Time
+	Kind   string // classification of the failure, see Classify
+	Reason string
+	Input  string // file containing the input
+}
+
+// outputSize is the size of the output of the server kept to
+// classify its failures.
+const outputSize = 1 << 20
+
+// tail keeps the last outputSize bytes written.
+type tail struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (t *tail) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.data = append(t.data, p...)
+	if len(t.data) > outputSize {
+		t.data = append([]byte{}, t.data[len(t.data)-outputSize:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tail) Bytes() []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]byte{}, t.data...)
+}
+
+// Supervisor runs the server in a child process and restarts it
+// each time an input breaks it. The inputs responsible for a restart
+// are saved in Dir. If Watch is set, the inputs after which the
+// server leaks resources beyond the limits of the target are treated
+// as failures.
+type Supervisor struct {
+	Command  []string // command line of the server listening on URL
+	URL      string
+	Dir      string
+	Watch    bool
+	Restarts []Restart
+
+	cmd      *exec.Cmd
+	exited   chan error
+	output   *tail // error output of the server
+	watchdog *Watchdog
+
+	// the inputs run with a read lock, the restarts with the
+	// lock.
+	lock       sync.RWMutex
+	generation int // number of starts
+}
+
+// NewSupervisor returns a supervisor for the server started by
+// command. The server shall listen on url.
+func NewSupervisor(command []string, url, dir string) *Supervisor {
+	return &Supervisor{
+		Command: command,
+		URL:     url,
+		Dir:     dir,
+	}
+}
+
+// Start launches the server and waits until it authenticates
+// clients.
+func (s *Supervisor) Start() error {
+	if strings.HasPrefix(s.URL, "unix://") {
+		// remove the socket left by a previous instance.
+		os.Remove(strings.TrimPrefix(s.URL, "unix://"))
+	}
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	s.output = &tail{}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, s.output)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start server: %s", err)
+	}
+	s.cmd = cmd
+	s.generation++
+	s.exited = make(chan error, 1)
+	go func() {
+		s.exited <- cmd.Wait()
+	}()
+
+	t := CurrentTarget()
+	t.URL = s.URL
+	SetTarget(t)
+
+	deadline := time.Now().Add(time.Duration(currentTarget().HealthTimeout))
+	for {
+		err := pingGateway()
+		if err == nil {
+			return s.watch()
+		}
+		select {
+		case err := <-s.exited:
+			s.cmd = nil
+			return fmt.Errorf("server exited: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			s.Stop()
+			return fmt.Errorf("server not ready: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// watch measures the baseline usage of the server.
+func (s *Supervisor) watch() error {
+	s.watchdog = nil
+	if !s.Watch {
+		return nil
+	}
+	watchdog, err := NewWatchdog(s.cmd.Process.Pid, currentTarget().Limits)
+	if err != nil {
+		s.Stop()
+		return fmt.Errorf("watchdog: %s", err)
+	}
+	s.watchdog = watchdog
+	return nil
+}
+
+// Stop kills the server.
+func (s *Supervisor) Stop() error {
+	if s.cmd == nil {
+		return nil
+	}
+	s.cmd.Process.Kill()
+	<-s.exited
+	s.cmd = nil
+	return nil
+}
+
+// classify returns the kind of failure. The output of the server
+// tells why it exited, if it did.
+func (s *Supervisor) classify(failure error) string {
+	output := s.output.Bytes()
+	if bytes.Contains(output, []byte("panic: ")) ||
+		bytes.Contains(output, []byte("fatal error: ")) {
+		return Classify(output, true, 2).Kind
+	}
+	if errors.Is(failure, errTimeout) {
+		return KindHang
+	}
+	return Classify([]byte("panic: "+failure.Error()), true, 2).Kind
+}
+
+// save writes the input in Dir and returns the name of the file.
+func (s *Supervisor) save(data []byte) (string, error) {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", err
+	}
+	// the inputs of the previous runs are kept.
+	file, err := ioutil.TempFile(s.Dir, "restart-*.bin")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	return file.Name(), err
+}
+
+// restart records the input responsible for a failure and restarts
+// the server. The lock shall be held.
+func (s *Supervisor) restart(data []byte, failure error) error {
+	// the output of the server is complete once stopped.
+	s.Stop()
+	input, saveErr := s.save(data)
+	s.Restarts = append(s.Restarts, Restart{
+		Time:   time.Now(),
+		Kind:   s.classify(failure),
+		Reason: failure.Error(),
+		Input:  input,
+	})
+	if err := s.Start(); err != nil {
+		return err
+	}
+	return saveErr
+}
+
+// try executes a fuzz entry point with data and returns the failure
+// detected by the entry point or the exit of the server.
+func (s *Supervisor) try(fuzz func([]byte) int, data []byte) (ret int, failure error) {
+	defer func() {
+		if r := recover(); r != nil {
+			failure = recovered(r)
+		}
+		select {
+		case err := <-s.exited:
+			failure = fmt.Errorf("server exited: %v", err)
+			s.exited <- err
+		default:
+		}
+	}()
+	return fuzz(data), nil
+}
+
+// check runs the watchdog with the lock held: the inputs of the other
+// workers are not counted. The server restarted since generation is
+// not checked.
+func (s *Supervisor) check(generation int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.watchdog == nil || s.generation != generation {
+		return nil
+	}
+	return s.watchdog.Check()
+}
+
+// Run executes a fuzz entry point with data. If the entry point
+// detects a failure, if the server process exits or if the watchdog
+// detects a leak once the workers are idle, the input is
+// recorded, the server is restarted and the failure is returned.
+// The outcome is recorded in the campaign statistics. Run can be
+// called concurrently: an input failing while the server is
+// restarted by another one is not recorded.
+func (s *Supervisor) Run(fuzz func([]byte) int, data []byte) (int, error) {
+	s.lock.RLock()
+	generation := s.generation
+	ret, failure := s.try(fuzz, data)
+	s.lock.RUnlock()
+	if failure == nil && s.Watch {
+		failure = s.check(generation)
+	}
+	recordRun(ret, failure)
+	if failure == nil {
+		return ret, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.generation != generation {
+		return ret, fmt.Errorf("%s (server restarted meanwhile)", failure)
+	}
+	if err := s.restart(data, failure); err != nil {
+		failure = fmt.Errorf("%s (restart failed: %s)", failure, err)
+	}
+	return ret, failure
+}
+
+// checkWorkers panics unless n workers can run the inputs.
+func checkWorkers(n int) {
+	if n < 1 {
+		panic(fmt.Sprintf("invalid number of workers: %d", n))
+	}
+}
+
+// RunWorkers executes a fuzz entry point with each input using n
+// concurrent workers, n being at least 1. It returns the failure of
+// each input, see Run.
+func (s *Supervisor) RunWorkers(fuzz func([]byte) int, inputs [][]byte,
+	n int) []error {
+	checkWorkers(n)
+	failures := make([]error, len(inputs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				_, failures[i] = s.Run(fuzz, inputs[i])
+			}
+		}()
+	}
+	for i := range inputs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return failures
+}
+
+// RunGenerated executes a fuzz entry point with count inputs produced
+// by generate using n concurrent workers, n being at least 1. Each
+// worker has its own Generator, the worker w being seeded with
+// seed+w: the input i is produced by the worker i%n, the inputs only
+// depend on seed and n. It returns the failure of each input, see
+// Run.
+func (s *Supervisor) RunGenerated(fuzz func([]byte) int,
+	generate func(g *Generator) []byte, count, n int, seed int64) []error {
+	checkWorkers(n)
+	failures := make([]error, count)
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			g := NewGenerator(seed + int64(w))
+			for i := w; i < count; i += n {
+				_, failures[i] = s.Run(fuzz, generate(g))
+			}
+		}(w)
+	}
+	wg.Wait()
+	return failures
+}
+
+// FuzzService fuzzes an object of the server like FuzzService. The
+// server is restarted after each crash and the fuzzing goes on: the
+// session reproducing the crash is recorded like the inputs of Run.
+func (s *Supervisor) FuzzService(g *Generator, serviceID, objectID uint32,
+	iterations int) ([]ActionStats, error) {
+	restart := func(input []byte, failure error) error {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.restart(input, failure)
+	}
+	return fuzzService(g, serviceID, objectID, iterations, restart)
+}
@@ -0,0 +1,215 @@
+package fuzz
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	gonet "net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+)
+
+// Environment variables used to configure the target.
+const (
+	EnvConfig = "FUZZ_CONFIG" // path of a JSON configuration file
+	EnvURL    = "FUZZ_URL"
+	EnvUser   = "FUZZ_USER"
+	EnvToken  = "FUZZ_TOKEN"
+)
+
+// Duration is a time.Duration represented as a string ("5s") in
+// JSON.
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration from a string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// TLSOptions configures the TLS connections (tcps:// URLs).
+type TLSOptions struct {
+	// Verify enables the verification of the server certificate.
+	Verify     bool   `json:"verify"`
+	ServerName string `json:"server_name"`
+	CAFile     string `json:"ca_file"`
+	CertFile   string `json:"cert_file"` // client certificate
+	KeyFile    string `json:"key_file"`
+}
+
+func (o TLSOptions) config() (*tls.Config, error) {
+	conf := &tls.Config{
+		InsecureSkipVerify: !o.Verify,
+		ServerName:         o.ServerName,
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// Limits are the increases of the resources used by the server
+// tolerated after an input, see Watchdog. Zero disables the check of
+// a resource.
+type Limits struct {
+	Goroutines  int `json:"goroutines"`
+	HeapMB      int `json:"heap_mb"`
+	Files       int `json:"files"`
+	Connections int `json:"connections"`
+}
+
+// Target describes the server to fuzz. An empty URL designates the
+// in-process server.
+type Target struct {
+	URL           string     `json:"url"`
+	User          string     `json:"user"`
+	Token         string     `json:"token"`
+	CallTimeout   Duration   `json:"call_timeout"`
+	HealthTimeout Duration   `json:"health_timeout"`
+	TLS           TLSOptions `json:"tls"`
+	Limits        Limits     `json:"limits"`
+	// SkipOversized ignores the inputs announcing more elements
+	// than they contain instead of reporting a memory exhaustion.
+	SkipOversized bool `json:"skip_oversized"`
+}
+
+// DefaultTarget returns the configuration of the in-process server.
+func DefaultTarget() Target {
+	return Target{
+		User:          "nao",
+		Token:         "nao",
+		CallTimeout:   Duration(5 * time.Second),
+		HealthTimeout: Duration(5 * time.Second),
+		Limits: Limits{
+			Goroutines:  100,
+			HeapMB:      64,
+			Files:       64,
+			Connections: 64,
+		},
+	}
+}
+
+// LoadTarget returns the default target updated with the
+// configuration file designated by FUZZ_CONFIG, then with the
+// variables FUZZ_URL, FUZZ_USER and FUZZ_TOKEN.
+func LoadTarget() (Target, error) {
+	t := DefaultTarget()
+	if filename := os.Getenv(EnvConfig); filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return t, err
+		}
+		if err = json.Unmarshal(data, &t); err != nil {
+			return t, fmt.Errorf("parse %s: %s", filename, err)
+		}
+	}
+	if u := os.Getenv(EnvURL); u != "" {
+		t.URL = u
+	}
+	if user := os.Getenv(EnvUser); user != "" {
+		t.User = user
+	}
+	if token := os.Getenv(EnvToken); token != "" {
+		t.Token = token
+	}
+	return t, nil
+}
+
+// CurrentTarget returns the configuration of the target being
+// fuzzed. Its URL is empty until the in-process server is used.
+func CurrentTarget() Target {
+	targetMutex.Lock()
+	defer targetMutex.Unlock()
+	return target
+}
+
+// SetTarget changes the target being fuzzed and closes the
+// connections to the previous one. An empty URL designates the
+// in-process server.
+func SetTarget(t Target) {
+	targetMutex.Lock()
+	target = t
+	targetMutex.Unlock()
+	pool.Reset()
+}
+
+// dialConn opens a raw connection to the target: unlike
+// net.DialEndPoint, the bytes written are not checked.
+func (t Target) dialConn() (gonet.Conn, error) {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %s", err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		return gonet.Dial("tcp", u.Host)
+	case "tcps":
+		conf, err := t.TLS.config()
+		if err != nil {
+			return nil, fmt.Errorf("tls configuration: %s", err)
+		}
+		return tls.Dial("tcp", u.Host, conf)
+	case "unix":
+		return gonet.Dial("unix", strings.TrimPrefix(t.URL, "unix://"))
+	default:
+		return nil, fmt.Errorf("unknown URL scheme: %s", t.URL)
+	}
+}
+
+// dial returns an unauthenticated endpoint connected to the target.
+func (t Target) dial() (net.EndPoint, error) {
+	conn, err := t.dialConn()
+	if err != nil {
+		return nil, err
+	}
+	return net.ConnEndPoint(conn), nil
+}
+
+// authenticate returns an endpoint authenticated with the target
+// credentials.
+func (t Target) authenticate() (net.EndPoint, error) {
+	endpoint, err := t.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to contact %s: %s", t.URL, err)
+	}
+	err = bus.AuthenticateUser(endpoint, t.User, t.Token)
+	if err != nil {
+		endpoint.Close()
+		return nil, fmt.Errorf("failed to authenticate: %s", err)
+	}
+	return endpoint, nil
+}
@@ -0,0 +1,229 @@
+package fuzz
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Targets lists the fuzz entry points by name.
+var Targets = map[string]func([]byte) int{
+	"auth":       Fuzz,
+	"serializer": FuzzSerializer,
+	"roundtrip":  FuzzRoundTrip,
+	"message":    FuzzMessage,
+	"session":    FuzzSession,
+	"objectref":  FuzzObjectReference,
+	"metaobject": FuzzMetaObject,
+	"metareply":  FuzzMetaObjectReply,
+	"signature":  FuzzSignature,
+	"client":     FuzzClient,
+}
+
+// TargetNames returns the names of the entry points in alphabetical
+// order.
+func TargetNames() []string {
+	names := make([]string, 0, len(Targets))
+	for name := range Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Kinds of failure.
+const (
+	KindNone              = "none"
+	KindPanic             = "panic"
+	KindHang              = "hang"
+	KindAuthBroken        = "auth broken"
+	KindConnectionRefused = "connection refused"
+	KindServerFailure     = "server failure"
+	KindLeak              = "resource leak"
+	KindMemory            = "memory exhaustion"
+	KindUnknown           = "unknown"
+)
+
+// Finding is the classification of the failure caused by an input.
+type Finding struct {
+	Kind    string
+	Message string // panic or error message
+	Stack   string // stack trace of the panicking goroutine
+	Hash    string // identifies the bug
+}
+
+// Key returns the name used to group duplicated findings.
+func (f Finding) Key() string {
+	return strings.Replace(f.Kind, " ", "-", -1) + "-" + f.Hash
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s (%s): %s", f.Kind, f.Hash, f.Message)
+}
+
+var (
+	argsExp   = regexp.MustCompile(`\(.*\)$`)
+	goexitExp = regexp.MustCompile(`^(created by |goroutine \d+ )`)
+)
+
+// stackFrames returns up to max function names of the first
+// goroutine found in a stack trace without the arguments.
+func stackFrames(stack string, max int) []string {
+	frames := make([]string, 0, max)
+	scanner := bufio.NewScanner(strings.NewReader(stack))
+	for scanner.Scan() && len(frames) < max {
+		line := scanner.Text()
+		if line == "" && len(frames) != 0 {
+			break
+		}
+		if line == "" || strings.HasPrefix(line, "\t") ||
+			goexitExp.MatchString(line) {
+			continue
+		}
+		frames = append(frames, argsExp.ReplaceAllString(line, ""))
+	}
+	return frames
+}
+
+// fatalFrames returns up to max function names of the goroutine
+// which caused a fatal error, without the functions of the runtime.
+func fatalFrames(stack string, max int) []string {
+	if i := strings.Index(stack, "\ngoroutine "); i != -1 {
+		stack = stack[i+1:]
+	}
+	frames := make([]string, 0, max)
+	for _, frame := range stackFrames(stack, 50) {
+		if len(frames) == max {
+			break
+		}
+		if !strings.HasPrefix(frame, "runtime.") {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+func hash(texts ...string) string {
+	h := sha1.New()
+	for _, text := range texts {
+		h.Write([]byte(text))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// splitMessage returns the first line of text and the stack trace
+// which follows.
+func splitMessage(text string) (string, string) {
+	if i := strings.Index(text, "\n"); i != -1 {
+		return text[:i], strings.TrimSpace(text[i:])
+	}
+	return text, ""
+}
+
+// isConnectionFailure returns true if message reports that the
+// server could not be reached.
+func isConnectionFailure(message string) bool {
+	return message == "gateway has crashed" ||
+		strings.Contains(message, "failed to contact") ||
+		strings.Contains(message, "connection refused")
+}
+
+// Classify analyses the output of a process which replayed an
+// input. exited is false if the process was killed after a timeout.
+func Classify(output []byte, exited bool, exitCode int) Finding {
+	if !exited {
+		return Finding{
+			Kind:    KindHang,
+			Message: "process timeout",
+			Hash:    hash(KindHang),
+		}
+	}
+	if exitCode == 0 {
+		return Finding{Kind: KindNone, Hash: hash(KindNone)}
+	}
+	text := string(output)
+	if i := strings.Index(text, "panic: "); i != -1 {
+		message, stack := splitMessage(text[i+len("panic: "):])
+		message = strings.TrimSuffix(message, " [recovered]")
+		kind := KindPanic
+		switch {
+		case message == errTimeout.Error():
+			kind = KindHang
+		case isConnectionFailure(message):
+			// the address of the server is not part of the hash.
+			return Finding{KindConnectionRefused, message, stack,
+				hash(KindConnectionRefused)}
+		case message == "gateway is broken":
+			kind = KindAuthBroken
+		case strings.HasPrefix(message, KindMemory),
+			strings.Contains(message, "makeslice: len out of range"):
+			// group by decoder: the sizes are not part of the
+			// hash.
+			key := []string{KindMemory,
+				digitsExp.ReplaceAllString(message, "N")}
+			frames := stackFrames(stack, 5)
+			return Finding{KindMemory, message, stack,
+				hash(append(key, frames...)...)}
+		case strings.HasPrefix(message, KindLeak):
+			// group the leaks by resource.
+			return Finding{KindLeak, message, stack,
+				hash(KindLeak, digitsExp.ReplaceAllString(message, "N"))}
+		}
+		if kind != KindPanic {
+			return Finding{kind, message, stack, hash(kind, message)}
+		}
+		frames := stackFrames(stack, 5)
+		return Finding{
+			Kind:    kind,
+			Message: message,
+			Stack:   stack,
+			Hash:    hash(append([]string{message}, frames...)...),
+		}
+	}
+	if i := strings.Index(text, "Server: failed with error"); i != -1 {
+		message := strings.SplitN(text[i:], "\n", 2)[0]
+		return Finding{
+			Kind:    KindServerFailure,
+			Message: message,
+			Hash:    hash(KindServerFailure, message),
+		}
+	}
+	if i := strings.Index(text, "fatal error: "); i != -1 {
+		// failure of the runtime: the stack trace identifies the
+		// bug like a panic.
+		message, stack := splitMessage(text[i:])
+		kind := KindUnknown
+		if strings.Contains(message, "out of memory") {
+			kind = KindMemory
+		}
+		frames := fatalFrames(stack, 5)
+		return Finding{
+			Kind:    kind,
+			Message: message,
+			Stack:   stack,
+			Hash:    hash(append([]string{kind, message}, frames...)...),
+		}
+	}
+	lines := strings.Split(string(bytes.TrimSpace(output)), "\n")
+	message := lines[len(lines)-1]
+	if isConnectionFailure(message) {
+		return Finding{
+			Kind:    KindConnectionRefused,
+			Message: message,
+			Hash:    hash(KindConnectionRefused),
+		}
+	}
+	// the messages logged by log.Fatalf start with the date and
+	// can contain the values of the input.
+	return Finding{
+		Kind:    KindUnknown,
+		Message: message,
+		Hash:    hash(KindUnknown, errorKey(message)),
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lugu/audit/fuzz"
+)
+
+// bug groups the inputs producing the same finding.
+type bug struct {
+	finding fuzz.Finding
+	inputs  []string
+}
+
+// child replays a single input against the in-process server of this
+// process. A panic terminates the process with its stack trace.
+func child(target, filename string, watch bool) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	entry := fuzz.Targets[target]
+	if watch {
+		if entry, err = fuzz.Watch(entry); err != nil {
+			log.Fatalf("watchdog: %s", err)
+		}
+	}
+	entry(data)
+}
+
+// replay runs the input in a child process, hence with a fresh
+// server, and classifies the failure.
+func replay(target, filename string, timeout time.Duration,
+	watch bool) fuzz.Finding {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-child",
+		"-target", target, fmt.Sprintf("-watch=%t", watch), filename)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fuzz.Classify(output, false, 0)
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		return fuzz.Classify(output, true, exit.ExitCode())
+	} else if err != nil {
+		log.Fatalf("failed to run %s: %s", filename, err)
+	}
+	return fuzz.Classify(output, true, 0)
+}
+
+func writeReport(dir string, b *bug) error {
+	filename := filepath.Join(dir, b.finding.Key()+".txt")
+	var report strings.Builder
+	fmt.Fprintf(&report, "kind: %s\n", b.finding.Kind)
+	fmt.Fprintf(&report, "hash: %s\n", b.finding.Hash)
+	fmt.Fprintf(&report, "message: %s\n", b.finding.Message)
+	fmt.Fprintf(&report, "inputs (%d):\n", len(b.inputs))
+	for _, input := range b.inputs {
+		fmt.Fprintf(&report, "\t%s\n", input)
+	}
+	if b.finding.Stack != "" {
+		fmt.Fprintf(&report, "\n%s\n", b.finding.Stack)
+	}
+	return ioutil.WriteFile(filename, []byte(report.String()), 0644)
+}
+
+func main() {
+	dir := "triage"
+	flag.StringVar(&dir, "d", dir, "report directory")
+	var target = flag.String("target", "auth",
+		"fuzz target: "+strings.Join(fuzz.TargetNames(), ", "))
+	var timeout = flag.Duration("timeout", 30*time.Second,
+		"maximum duration of a replay")
+	var isChild = flag.Bool("child", false, "replay a single input")
+	var watch = flag.Bool("watch", false, "report the inputs leaking resources")
+	flag.Parse()
+
+	if _, ok := fuzz.Targets[*target]; !ok {
+		log.Fatalf("unknown target: %s", *target)
+	}
+	if *isChild {
+		child(*target, flag.Arg(0), *watch)
+		return
+	}
+
+	bugs := make(map[string]*bug)
+	for _, filename := range flag.Args() {
+		finding := replay(*target, filename, *timeout, *watch)
+		log.Printf("%s: %s", filename, finding)
+		if finding.Kind == fuzz.KindNone {
+			continue
+		}
+		b, ok := bugs[finding.Key()]
+		if !ok {
+			b = &bug{finding: finding}
+			bugs[finding.Key()] = b
+		}
+		b.inputs = append(b.inputs, filename)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("%s", err)
+	}
+	keys := make([]string, 0, len(bugs))
+	for key := range bugs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b := bugs[key]
+		if err := writeReport(dir, b); err != nil {
+			log.Fatalf("failed to write report: %s", err)
+		}
+		fmt.Printf("%s: %d input(s)\n", b.finding, len(b.inputs))
+	}
+	fmt.Printf("%d unique bug(s) in %d input(s)\n", len(bugs),
+		flag.NArg())
+}
@@ -0,0 +1,201 @@
+package fuzz
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Usage is a snapshot of the resources used by the server.
+type Usage struct {
+	Goroutines  int    // -1 for a child process
+	Heap        uint64 // live heap in-process, resident memory of a child
+	Files       int    // open file descriptors
+	Connections int    // open sockets
+}
+
+func (u Usage) String() string {
+	return fmt.Sprintf("goroutines %d, heap %d MB, files %d, connections %d",
+		u.Goroutines, u.Heap>>20, u.Files, u.Connections)
+}
+
+// procDir returns the /proc directory of a process, 0 designating
+// the current process.
+func procDir(pid int) string {
+	if pid == 0 {
+		return "/proc/self"
+	}
+	return filepath.Join("/proc", strconv.Itoa(pid))
+}
+
+// readFiles counts the open file descriptors and sockets of a
+// process.
+func readFiles(pid int) (files, sockets int, err error) {
+	dir := filepath.Join(procDir(pid), "fd")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		link, err := os.Readlink(filepath.Join(dir, e.Name()))
+		if err != nil {
+			// closed meanwhile
+			continue
+		}
+		files++
+		if strings.HasPrefix(link, "socket:") {
+			sockets++
+		}
+	}
+	return files, sockets, nil
+}
+
+// readResident returns the resident memory of a process.
+func readResident(pid int) (uint64, error) {
+	file, err := os.Open(filepath.Join(procDir(pid), "status"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb << 10, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("missing VmRSS")
+}
+
+// ReadUsage returns the resources used by a process, 0 designating
+// the current process (hence the in-process server). Only supported
+// on Linux.
+func ReadUsage(pid int) (Usage, error) {
+	var u Usage
+	var err error
+	u.Files, u.Connections, err = readFiles(pid)
+	if err != nil {
+		return u, err
+	}
+	if pid != 0 {
+		u.Goroutines = -1
+		u.Heap, err = readResident(pid)
+		return u, err
+	}
+	u.Goroutines = runtime.NumGoroutine()
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	u.Heap = stats.HeapAlloc
+	return u, nil
+}
+
+// errLeak is returned when the server uses more resources than
+// tolerated.
+var errLeak = errors.New("resource leak")
+
+// Watchdog detects the inputs after which the server does not
+// release its resources: the usage of the server is compared with
+// the usage measured when the watchdog is created.
+type Watchdog struct {
+	Baseline Usage
+	pid      int
+	limits   Limits
+}
+
+// measure returns the usage of the server once the idle connections
+// of the pool are closed: they are counted by the server and, in
+// process, by the fuzzer as well.
+func measure(pid int) (Usage, error) {
+	pool.Reset()
+	return ReadUsage(pid)
+}
+
+// NewWatchdog measures the baseline usage of a process, 0
+// designating the current process. The pool is drained first.
+func NewWatchdog(pid int, limits Limits) (*Watchdog, error) {
+	baseline, err := measure(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &Watchdog{
+		Baseline: baseline,
+		pid:      pid,
+		limits:   limits,
+	}, nil
+}
+
+// exceeded lists the resources of u beyond the limits.
+func (w *Watchdog) exceeded(u Usage) []string {
+	var leaks []string
+	check := func(name string, increase int64, limit int) {
+		if limit != 0 && increase > int64(limit) {
+			leaks = append(leaks, fmt.Sprintf("%s +%d (limit %d)",
+				name, increase, limit))
+		}
+	}
+	if u.Goroutines != -1 {
+		check("goroutines", int64(u.Goroutines-w.Baseline.Goroutines),
+			w.limits.Goroutines)
+	}
+	check("heap MB", (int64(u.Heap)-int64(w.Baseline.Heap))>>20,
+		w.limits.HeapMB)
+	check("files", int64(u.Files-w.Baseline.Files), w.limits.Files)
+	check("connections", int64(u.Connections-w.Baseline.Connections),
+		w.limits.Connections)
+	return leaks
+}
+
+// Check returns an error wrapping errLeak if the resources used by
+// the server are still beyond the limits after the health-check
+// timeout. The pool is drained before each measure: Check shall not
+// run concurrently with the inputs.
+func (w *Watchdog) Check() error {
+	deadline := time.Now().Add(time.Duration(currentTarget().HealthTimeout))
+	for {
+		u, err := measure(w.pid)
+		if err != nil {
+			return err
+		}
+		leaks := w.exceeded(u)
+		if len(leaks) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s", errLeak, strings.Join(leaks, ", "))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Watch returns an entry point running entry and checking the
+// resources of the in-process server afterwards: it panics if the
+// server leaks. The baseline is measured once the server has
+// authenticated a client.
+func Watch(entry func([]byte) int) (func([]byte) int, error) {
+	if err := pingGateway(); err != nil {
+		return nil, err
+	}
+	watchdog, err := NewWatchdog(0, currentTarget().Limits)
+	if err != nil {
+		return nil, err
+	}
+	return func(data []byte) int {
+		ret := entry(data)
+		if err := watchdog.Check(); err != nil {
+			panic(err.Error())
+		}
+		return ret
+	}, nil
+}
@@ -1,12 +1,16 @@
 module github.com/lugu/audit
 
-go 1.13
+go 1.20
 
 require (
 	github.com/google/gofuzz v1.2.0
 	github.com/lugu/qiloop v0.14.2
-	github.com/yuin/goldmark v1.6.0 // indirect
+)
+
+require (
+	github.com/dave/jennifer v1.7.0 // indirect
+	github.com/denisbrodbeck/machineid v1.0.1 // indirect
+	github.com/ftrvxmtrx/fd v0.0.0-20150925145434-c6d800382fff // indirect
+	github.com/prataprc/goparsec v0.0.0-20211219142520-daac0e635e7e // indirect
 	golang.org/x/sys v0.15.0 // indirect
-	golang.org/x/tools v0.15.0 // indirect
-	golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028 // indirect
 )
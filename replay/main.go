@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/qiloop/bus/net"
+)
+
+// receiver collects the messages sent by the server.
+type receiver struct {
+	mutex    sync.Mutex
+	messages []net.Message
+	ids      map[uint32]bool // IDs of the responses received
+	notify   chan struct{}
+	closed   chan struct{}
+}
+
+func newReceiver(endpoint net.EndPoint) *receiver {
+	r := &receiver{
+		ids:    make(map[uint32]bool),
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	filter := func(hdr *net.Header) (matched bool, keep bool) {
+		return true, true
+	}
+	consumer := func(msg *net.Message) error {
+		r.mutex.Lock()
+		r.messages = append(r.messages, *msg)
+		r.ids[msg.Header.ID] = true
+		r.mutex.Unlock()
+		select {
+		case r.notify <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	closer := func(err error) {
+		close(r.closed)
+	}
+	endpoint.AddHandler(filter, consumer, closer)
+	return r
+}
+
+// received returns true once the messages ids have been answered.
+func (r *receiver) received(ids []uint32) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, id := range ids {
+		if !r.ids[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// wait waits for the responses to ids until the timeout or the end of
+// the connection.
+func (r *receiver) wait(ids []uint32, timeout time.Duration) {
+	deadline := time.After(timeout)
+	for !r.received(ids) {
+		select {
+		case <-r.notify:
+		case <-r.closed:
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// replay sends the requests of a recorded connection to addr and
+// returns the messages received, the responses carrying the recorded
+// IDs, and the number of requests sent. The requests are spaced like
+// the recorded ones multiplied by pace. The authentication waits for
+// the response of the server.
+func replay(addr string, requests, responses []capture.Record,
+	rewriter *capture.Rewriter, pace float64,
+	timeout time.Duration) ([]net.Message, int, error) {
+
+	endpoint, err := net.DialEndPoint(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer endpoint.Close()
+	r := newReceiver(endpoint)
+
+	// number of responses recorded per call.
+	answered := make(map[capture.CallKey]int)
+	for _, m := range responses {
+		if capture.IsResponse(m.Message) {
+			answered[capture.NewCallKey(m.Message.Header)]++
+		}
+	}
+	var expected []uint32
+	sent := 0
+	for i, request := range requests {
+		if i > 0 && pace > 0 {
+			delay := request.Time.Sub(requests[i-1].Time)
+			time.Sleep(time.Duration(float64(delay) * pace))
+		}
+		m := rewriter.Rewrite(request.Message)
+		if err := endpoint.Send(m); err != nil {
+			log.Printf("connection closed after %d message(s): %s", i, err)
+			break
+		}
+		sent++
+		if key := capture.NewCallKey(request.Message.Header); answered[key] > 0 {
+			answered[key]--
+			expected = append(expected, m.Header.ID)
+		}
+		if capture.IsAuthentication(request.Message) &&
+			request.Message.Header.Type == net.Call {
+			r.wait([]uint32{m.Header.ID}, timeout)
+		}
+	}
+	r.wait(expected, timeout)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	messages := make([]net.Message, len(r.messages))
+	for i, m := range r.messages {
+		// only the responses carry the ID of a request: the
+		// events and the capabilities have their own IDs.
+		if id, ok := rewriter.Recorded(m.Header.ID); ok && capture.IsResponse(m) {
+			m.Header.ID = id
+		}
+		messages[i] = m
+	}
+	return messages, sent, nil
+}
+
+func main() {
+	var addr = flag.String("url", "", "server address (tcp://host:port)")
+	var connection = flag.Uint("connection", 0,
+		"recorded connection to replay (default: the first one)")
+	var pace = flag.Float64("pace", 1,
+		"delay between the messages relative to the recording (0: no delay)")
+	var user = flag.String("user", "", "replace the recorded user")
+	var token = flag.String("token", "", "replace the recorded token")
+	var timeout = flag.Duration("timeout", 2*time.Second,
+		"time to wait for the responses")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s -url <url> [options] <capture file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *addr == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	records, err := capture.ReadAll(file)
+	file.Close()
+	if err != nil {
+		if len(records) == 0 {
+			log.Fatalf("%s: %s", flag.Arg(0), err)
+		}
+		log.Printf("%s: %s", flag.Arg(0), err)
+	}
+	id := uint32(*connection)
+	if id == 0 {
+		ids := capture.Connections(records)
+		if len(ids) == 0 {
+			log.Fatalf("%s: no message recorded", flag.Arg(0))
+		}
+		id = ids[0]
+	}
+	requests := capture.Messages(records,
+		capture.Stream{Connection: id, Direction: capture.ClientToServer})
+	responses := capture.Messages(records,
+		capture.Stream{Connection: id, Direction: capture.ServerToClient})
+	if len(requests) == 0 {
+		log.Fatalf("connection #%d: no message sent by the client", id)
+	}
+
+	// learn the names of the services from the recording only:
+	// the responses are described without learning from them.
+	resolver := capture.NewResolver()
+	for _, r := range records {
+		if r.Kind == capture.Message {
+			resolver.Resolve(r.Message)
+		}
+	}
+	describe := func(m *net.Message) string {
+		if a := resolver.Lookup(*m).String(); a != "" {
+			return fmt.Sprintf("%s %s", m.Header, a)
+		}
+		return m.Header.String()
+	}
+
+	rewriter := capture.NewRewriter(*user, *token)
+	replayed, sent, err := replay(*addr, requests, responses, rewriter, *pace,
+		*timeout)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	recorded := make([]net.Message, len(responses))
+	for i, r := range responses {
+		recorded[i] = r.Message
+	}
+	same, diffs := capture.DiffResponses(recorded, replayed, resolver)
+	for _, d := range diffs {
+		switch {
+		case d.Replayed == nil:
+			fmt.Printf("id %d: no response\n\trecorded: %s\n",
+				d.ID, describe(d.Recorded))
+		case d.Recorded == nil:
+			fmt.Printf("id %d: unexpected response\n\treplayed: %s\n",
+				d.ID, describe(d.Replayed))
+		default:
+			fmt.Printf("id %d: different response\n\trecorded: %s\n\treplayed: %s\n",
+				d.ID, describe(d.Recorded), describe(d.Replayed))
+		}
+	}
+	fmt.Printf("connection #%d: %d message(s) sent, %d identical response(s), %d difference(s)\n",
+		id, sent, same, len(diffs))
+	if len(diffs) != 0 {
+		os.Exit(1)
+	}
+}
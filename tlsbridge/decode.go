@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/lugu/audit/capture"
+	"github.com/lugu/qiloop/bus/net"
+)
+
+var messageTypes = map[uint8]string{
+	net.Call:       "call",
+	net.Reply:      "reply",
+	net.Error:      "error",
+	net.Post:       "post",
+	net.Event:      "event",
+	net.Capability: "capability",
+	net.Cancel:     "cancel",
+	net.Cancelled:  "cancelled",
+}
+
+// formatHeader returns a one-line description of a message header.
+func formatHeader(hdr net.Header) string {
+	typ, ok := messageTypes[hdr.Type]
+	if !ok {
+		typ = fmt.Sprintf("unknown(%d)", hdr.Type)
+	}
+	return fmt.Sprintf("%s id %d service %d object %d action %d flags %#02x size %d",
+		typ, hdr.ID, hdr.Service, hdr.Object, hdr.Action, hdr.Flags,
+		hdr.Size)
+}
+
+// writeRecord timestamps a record and appends it to the capture and
+// to the pcapng export.
+func writeRecord(r capture.Record) {
+	r.Time = time.Now()
+	if err := captureWriter.Write(&r); err != nil {
+		log.Printf("capture: %s", err)
+	}
+	if pcapWriter == nil {
+		return
+	}
+	if err := pcapWriter.Write(&r); err != nil {
+		log.Printf("pcap: %s", err)
+	}
+}
+
+// decoder splits one direction of a connection into messages.
+type decoder struct {
+	connection uint32
+	direction  capture.Direction
+}
+
+func (d decoder) String() string {
+	return fmt.Sprintf("#%d %s", d.connection, d.direction)
+}
+
+// resolver names the services and the methods of the messages.
+var resolver = capture.NewResolver()
+
+// message logs and captures a message. The message is annotated with
+// the names learned from the previous messages.
+func (d decoder) message(m net.Message) {
+	if a := resolver.Resolve(m).String(); a != "" {
+		log.Printf("%s %s: %s", d, formatHeader(m.Header), a)
+	} else {
+		log.Printf("%s %s", d, formatHeader(m.Header))
+	}
+	writeRecord(capture.Record{
+		Kind:       capture.Message,
+		Connection: d.connection,
+		Direction:  d.direction,
+		Message:    m,
+	})
+}
+
+// data captures bytes which are not a message.
+func (d decoder) data(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	writeRecord(capture.Record{
+		Kind:       capture.Data,
+		Connection: d.connection,
+		Direction:  d.direction,
+		Data:       append([]byte{}, data...),
+	})
+}
+
+// close captures the termination of the stream.
+func (d decoder) close(err error) {
+	record := capture.Record{
+		Kind:       capture.Close,
+		Connection: d.connection,
+		Direction:  d.direction,
+	}
+	if err != io.EOF {
+		log.Printf("%s %s", d, err)
+		record.Err = err.Error()
+	}
+	writeRecord(record)
+}
+
+// errInvalid is returned when the stream is not a sequence of
+// messages.
+var errInvalid = errors.New("invalid message")
+
+// readHeader parses the header of a message.
+func readHeader(buf []byte) (net.Header, error) {
+	var hdr net.Header
+	if err := hdr.Read(bytes.NewReader(buf)); err != nil {
+		return hdr, fmt.Errorf("%w: %s", errInvalid, err)
+	}
+	if hdr.Size > net.MaxPayloadSize {
+		return hdr, fmt.Errorf("%w: payload too large: %d",
+			errInvalid, hdr.Size)
+	}
+	return hdr, nil
+}
+
+// readPayload reads from r the payload of the message whose header
+// hdr was read from buf. The bytes read are returned if they do not
+// form a message.
+func readPayload(hdr net.Header, buf []byte, r io.Reader) (m net.Message, raw []byte, err error) {
+	m.Header = hdr
+	m.Payload = make([]byte, hdr.Size)
+	n, err := io.ReadFull(r, m.Payload)
+	if err != nil {
+		return m, append(buf, m.Payload[:n]...), err
+	}
+	return m, nil, nil
+}
+
+// next reads a message from r. The bytes read are returned if they
+// do not form a message.
+func (d decoder) next(r io.Reader) (m net.Message, raw []byte, err error) {
+	buf := make([]byte, net.HeaderSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil {
+		return m, buf[:n], err
+	}
+	hdr, err := readHeader(buf)
+	if err != nil {
+		return m, buf, err
+	}
+	return readPayload(hdr, buf, r)
+}
+
+// resync skips the bytes of r up to the next valid header, then reads
+// the message like next. It is used once bytes are dropped: the
+// stream no longer starts with a header. The bytes skipped are
+// captured as raw data.
+func (d decoder) resync(r io.Reader) (m net.Message, raw []byte, err error) {
+	var skipped []byte
+	window := make([]byte, 0, net.HeaderSize)
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if errors.Is(err, errDropped) {
+			// the bytes of the window are not contiguous.
+			skipped = append(skipped, window...)
+			window = window[:0]
+			continue
+		} else if err != nil {
+			return m, append(skipped, window...), err
+		} else if n == 0 {
+			continue
+		}
+		window = append(window, b[0])
+		if len(window) < net.HeaderSize {
+			continue
+		}
+		if hdr, err := readHeader(window); err == nil {
+			d.data(skipped)
+			return readPayload(hdr, window, r)
+		}
+		skipped = append(skipped, window[0])
+		window = append(window[:0], window[1:]...)
+		if len(skipped) >= 32*1024 {
+			d.data(skipped)
+			skipped = skipped[:0]
+		}
+	}
+}
+
+// decode logs and captures the messages read from r. Once bytes are
+// dropped, the decoding resumes at the next valid header. Once the
+// stream cannot be decoded, the rest of it is captured as raw data.
+func (d decoder) decode(r io.Reader) {
+	next := d.next
+	for {
+		m, raw, err := next(r)
+		next = d.next
+		if errors.Is(err, errDropped) {
+			d.data(raw)
+			log.Printf("%s %s, resynchronizing", d, err)
+			next = d.resync
+			continue
+		} else if errors.Is(err, errInvalid) {
+			d.data(raw)
+			log.Printf("%s %s, stop decoding", d, err)
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			d.data(raw)
+			d.close(io.EOF)
+			return
+		} else if err != nil {
+			d.data(raw)
+			d.close(err)
+			return
+		}
+		d.message(m)
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		d.data(buf[:n])
+		if errors.Is(err, errDropped) {
+			log.Printf("%s %s", d, err)
+			continue
+		} else if err != nil {
+			d.close(err)
+			return
+		}
+	}
+}
+
+// errDropped is returned when the decoder lags behind the forwarding
+// and bytes of the stream are not decoded.
+var errDropped = errors.New("bytes dropped")
+
+// feedSize is the number of chunks queued for a decoder.
+const feedSize = 64
+
+// chunk is a piece of the stream forwarded.
+type chunk struct {
+	data    []byte
+	dropped int   // bytes dropped before data
+	err     error // end of the stream
+}
+
+// feed passes the bytes forwarded to a decoder without slowing the
+// forwarding down: the bytes are dropped when the queue is full.
+type feed struct {
+	chunks  chan chunk
+	dropped int // dropped by push and not reported yet
+
+	pending []byte // received by Read and not returned yet
+	err     error
+}
+
+func newFeed() *feed {
+	return &feed{
+		chunks: make(chan chunk, feedSize),
+	}
+}
+
+// push queues a copy of data, or drops it if the queue is full.
+func (f *feed) push(data []byte) {
+	c := chunk{
+		data:    append([]byte{}, data...),
+		dropped: f.dropped,
+	}
+	select {
+	case f.chunks <- c:
+		f.dropped = 0
+	default:
+		f.dropped += len(data)
+	}
+}
+
+// close ends the stream with err, io.EOF if err is nil. It waits for
+// the decoder to make room in the queue.
+func (f *feed) close(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	f.chunks <- chunk{dropped: f.dropped, err: err}
+	close(f.chunks)
+}
+
+// Read returns the bytes queued. An error wrapping errDropped is
+// returned where bytes are missing: the following bytes do not
+// continue the previous ones.
+func (f *feed) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		c := <-f.chunks
+		f.pending, f.err = c.data, c.err
+		if c.dropped != 0 {
+			return 0, fmt.Errorf("%w: %d bytes", errDropped, c.dropped)
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
@@ -1,13 +1,26 @@
 package main
 
 import (
-	"bufio"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/lugu/audit/capture"
+)
+
+var (
+	// captureWriter records the traffic of the connections.
+	captureWriter *capture.Writer
+	// pcapWriter exports the traffic as pcapng if not nil.
+	pcapWriter *capture.PcapWriter
+	// connections counts the connections forwarded.
+	connections uint32
 )
 
 func listenTLS(addr string) {
@@ -55,21 +68,89 @@ func listenRAW(addr, remoteAddr string) {
 			log.Fatalf("%s", err)
 			continue
 		}
-		forwardConnection(conn, connectRemote(remoteAddr))
+		// the messages are captured on the TLS hop: they go
+		// through both hops.
+		relay(conn, connectRemote(remoteAddr))
 	}
 }
 
-func copyAndClose(reader io.Reader, writer io.WriteCloser) {
-	file, _ := ioutil.TempFile(".", "qimessaging")
-	reader2 := io.TeeReader(reader, file)
-	if _, err := io.Copy(writer, bufio.NewReader(reader2)); err == nil {
+// copyAndClose forwards one direction of a connection from reader to
+// writer. The stream is decoded and captured as it goes: the decoder
+// is fed without waiting for it, see feed.
+func copyAndClose(d decoder, reader io.Reader, writer io.WriteCloser) {
+	f := newFeed()
+	go d.decode(f)
+	buf := make([]byte, 32*1024)
+	var err error
+	for {
+		n, rerr := reader.Read(buf)
+		if n > 0 {
+			if _, err = writer.Write(buf[:n]); err != nil {
+				break
+			}
+			f.push(buf[:n])
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+	if err == nil {
 		writer.Close()
 	}
+	f.close(err)
+}
+
+// peers describes the endpoints of a connection. The TLS session is
+// established if it is not already.
+func peers(client, server net.Conn) capture.Peers {
+	p := capture.Peers{
+		Client: client.RemoteAddr().String(),
+		Server: server.RemoteAddr().String(),
+	}
+	for _, conn := range []net.Conn{client, server} {
+		if conn, ok := conn.(*tls.Conn); ok {
+			if err := conn.Handshake(); err != nil {
+				log.Printf("handshake: %s", err)
+			}
+			state := conn.ConnectionState()
+			p.TLS = &capture.TLSInfo{
+				Version:     state.Version,
+				CipherSuite: state.CipherSuite,
+				ServerName:  state.ServerName,
+			}
+		}
+	}
+	return p
+}
+
+// relay forwards the traffic between client and server without
+// capturing it.
+func relay(client, server net.Conn) {
+	forward := func(reader io.Reader, writer io.WriteCloser) {
+		if _, err := io.Copy(writer, reader); err == nil {
+			writer.Close()
+		}
+	}
+	go forward(client, server)
+	go forward(server, client)
 }
 
+// forwardConnection forwards and captures the traffic between client
+// and server.
 func forwardConnection(client, server net.Conn) {
-	go copyAndClose(client, server)
-	go copyAndClose(server, client)
+	id := atomic.AddUint32(&connections, 1)
+	p := peers(client, server)
+	log.Printf("#%d %s -> %s (tls: %t)", id, p.Client, p.Server, p.TLS != nil)
+	writeRecord(capture.Record{
+		Kind:       capture.Open,
+		Connection: id,
+		Peers:      p,
+	})
+	go copyAndClose(decoder{id, capture.ClientToServer}, client, server)
+	go copyAndClose(decoder{id, capture.ServerToClient}, server, client)
 }
 
 func connectLocal() net.Conn {
@@ -97,6 +178,10 @@ func main() {
 	var remoteHost = flag.String("remote-host", "", "remote address (host:port)")
 	var localPort = flag.String("listen-port", ":9503", "local TLS port")
 	var forwardPort = flag.String("tcp-port", ":12345", "local TCP port loopback")
+	var captureFile = flag.String("capture",
+		fmt.Sprintf("qimessaging-%s.cap", time.Now().Format("20060102-150405")),
+		"capture file")
+	var pcapFile = flag.String("pcap", "", "export the traffic in pcapng format")
 
 	flag.Parse()
 
@@ -105,6 +190,27 @@ func main() {
 		return
 	}
 
+	file, err := os.Create(*captureFile)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	defer file.Close()
+	captureWriter, err = capture.NewWriter(file)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if *pcapFile != "" {
+		pcap, err := os.Create(*pcapFile)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		defer pcap.Close()
+		pcapWriter, err = capture.NewPcapWriter(pcap)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+
 	go listenRAW(*forwardPort, *remoteHost)
 	listenTLS(*localPort)
 }